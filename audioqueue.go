@@ -0,0 +1,282 @@
+/*
+audioqueue.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_AUDIO_QUEUE_MS = 2000
+)
+
+type AudioOverflowPolicy int
+
+const (
+	//Push waits for room, the capture side slows down with the link
+	AUDIO_OVERFLOW_BLOCK AudioOverflowPolicy = iota
+	//the pushed chunk is dropped
+	AUDIO_OVERFLOW_DROP_NEWEST
+	//queued chunks are dropped from the front until the new one fits
+	AUDIO_OVERFLOW_DROP_OLDEST
+)
+
+var ErrAudioQueueClosed = errors.New("audio queue closed")
+
+type AudioQueueStats struct {
+	//audio waiting to be sent, how far sending is behind the capture
+	Queued    time.Duration
+	MaxQueued time.Duration
+	SentBytes int64
+	//bytes lost to the overflow policy
+	DroppedBytes int64
+	Dropped      time.Duration
+	//the last send took this long
+	LastSend time.Duration
+}
+
+// AudioSendQueue sends audio from its own goroutine so the capture never
+// waits on the socket, e.g. with send set to st.SendAudioData. The buffer
+// is measured in milliseconds of audio, BytesPerMs is that of 16 bit mono
+// pcm at the given sample rate and must be changed before the first Push
+// for other formats.
+type AudioSendQueue struct {
+	BytesPerMs int
+	//OnLag is called once the queued audio exceeds LagThreshold, and again
+	//only after the queue fell below half of it
+	LagThreshold time.Duration
+	OnLag        func(queued time.Duration)
+
+	send     func(data []byte) error
+	bufferMs int
+	policy   AudioOverflowPolicy
+
+	lk     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	queued int
+	//bytes of the chunk being sent
+	inflight int
+	lagging  bool
+	closed   bool
+	err      error
+	stats    AudioQueueStats
+	done     chan struct{}
+}
+
+func NewAudioSendQueue(send func(data []byte) error, sampleRate int, bufferMs int, policy AudioOverflowPolicy) (*AudioSendQueue, error) {
+	if send == nil {
+		return nil, errors.New("empty send func")
+	}
+	if sampleRate <= 0 {
+		return nil, errors.New("invalid sample rate")
+	}
+	if bufferMs <= 0 {
+		bufferMs = DEFAULT_AUDIO_QUEUE_MS
+	}
+
+	q := new(AudioSendQueue)
+	q.BytesPerMs = sampleRate * 2 / 1000
+	q.send = send
+	q.bufferMs = bufferMs
+	q.policy = policy
+	q.cond = sync.NewCond(&q.lk)
+	q.done = make(chan struct{})
+	go q.run()
+	return q, nil
+}
+
+func (q *AudioSendQueue) duration(bytes int) time.Duration {
+	if q.BytesPerMs <= 0 {
+		return 0
+	}
+	return time.Duration(bytes) * time.Millisecond / time.Duration(q.BytesPerMs)
+}
+
+func (q *AudioSendQueue) capacity() int {
+	return q.bufferMs * q.BytesPerMs
+}
+
+// Push queues a copy of data. It returns ErrAudioQueueClosed after Close
+// and the error of the failed send once sending failed, queued audio is
+// discarded then.
+func (q *AudioSendQueue) Push(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	chunk := append([]byte(nil), data...)
+
+	q.lk.Lock()
+	//a chunk larger than the whole buffer still goes into an empty queue
+	for q.err == nil && !q.closed && q.pending() > 0 && q.pending()+len(chunk) > q.capacity() {
+		switch q.policy {
+		case AUDIO_OVERFLOW_DROP_NEWEST:
+			q.drop(len(chunk))
+			q.lk.Unlock()
+			return nil
+		case AUDIO_OVERFLOW_DROP_OLDEST:
+			if len(q.queue) == 0 {
+				//only the chunk in flight is left
+				break
+			}
+			q.drop(len(q.queue[0]))
+			q.queued -= len(q.queue[0])
+			q.queue[0] = nil
+			q.queue = q.queue[1:]
+			continue
+		default:
+			q.cond.Wait()
+			continue
+		}
+		break
+	}
+	if q.err != nil {
+		err := q.err
+		q.lk.Unlock()
+		return err
+	}
+	if q.closed {
+		q.lk.Unlock()
+		return ErrAudioQueueClosed
+	}
+
+	q.queue = append(q.queue, chunk)
+	q.queued += len(chunk)
+	queued := q.duration(q.pending())
+	if queued > q.stats.MaxQueued {
+		q.stats.MaxQueued = queued
+	}
+	lag := q.checkLag()
+	q.cond.Broadcast()
+	q.lk.Unlock()
+
+	if lag && q.OnLag != nil {
+		q.OnLag(queued)
+	}
+	return nil
+}
+
+// queued and in flight
+func (q *AudioSendQueue) pending() int {
+	return q.queued + q.inflight
+}
+
+func (q *AudioSendQueue) drop(bytes int) {
+	q.stats.DroppedBytes += int64(bytes)
+	q.stats.Dropped += q.duration(bytes)
+}
+
+// true when the lag threshold was just crossed
+func (q *AudioSendQueue) checkLag() bool {
+	if q.LagThreshold <= 0 {
+		return false
+	}
+	queued := q.duration(q.pending())
+	if !q.lagging && queued > q.LagThreshold {
+		q.lagging = true
+		return true
+	}
+	if q.lagging && queued < q.LagThreshold/2 {
+		q.lagging = false
+	}
+	return false
+}
+
+func (q *AudioSendQueue) run() {
+	defer close(q.done)
+	for {
+		q.lk.Lock()
+		for len(q.queue) == 0 && !q.closed && q.err == nil {
+			q.cond.Wait()
+		}
+		if len(q.queue) == 0 || q.err != nil {
+			q.lk.Unlock()
+			return
+		}
+		chunk := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.queued -= len(chunk)
+		q.inflight = len(chunk)
+		q.lk.Unlock()
+
+		begin := time.Now()
+		err := q.send(chunk)
+		took := time.Since(begin)
+
+		q.lk.Lock()
+		q.inflight = 0
+		q.stats.LastSend = took
+		if err != nil {
+			q.err = err
+			q.drop(q.queued)
+			q.queue = nil
+			q.queued = 0
+		} else {
+			q.stats.SentBytes += int64(len(chunk))
+		}
+		q.checkLag()
+		q.cond.Broadcast()
+		q.lk.Unlock()
+	}
+}
+
+func (q *AudioSendQueue) Stats() AudioQueueStats {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	stats := q.stats
+	stats.Queued = q.duration(q.pending())
+	return stats
+}
+
+// first send error, nil while sending works
+func (q *AudioSendQueue) Err() error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.err
+}
+
+// Close stops taking audio, waits until the queue is sent and returns the
+// send error if any. Call it before Stop so the tail of the audio is not
+// lost.
+func (q *AudioSendQueue) Close() error {
+	q.lk.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.lk.Unlock()
+
+	<-q.done
+	return q.Err()
+}
+
+// Abort discards the queued audio and stops, for a session being shut down.
+func (q *AudioSendQueue) Abort() {
+	q.lk.Lock()
+	q.closed = true
+	//the chunk in flight still goes out
+	q.drop(q.queued)
+	q.queue = nil
+	q.queued = 0
+	q.cond.Broadcast()
+	q.lk.Unlock()
+
+	<-q.done
+}
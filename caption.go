@@ -0,0 +1,294 @@
+/*
+caption.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	//a prefix is committed once this many partials in a row agree on it
+	DEFAULT_CAPTION_STABLE_UPDATES = 2
+
+	captionHistory = 16
+)
+
+// CaptionStability returns how many runes of the newest partial are
+// stable, given the partials of the current sentence, oldest first.
+type CaptionStability func(partials []string) int
+
+// StableAfterUpdates commits the common prefix of the last n partials.
+func StableAfterUpdates(n int) CaptionStability {
+	if n < 1 {
+		n = 1
+	}
+	return func(partials []string) int {
+		if len(partials) < n {
+			return 0
+		}
+		recent := partials[len(partials)-n:]
+		stable := []rune(recent[len(recent)-1])
+		for _, p := range recent[:len(recent)-1] {
+			stable = stable[:commonPrefix(stable, []rune(p))]
+		}
+		return len(stable)
+	}
+}
+
+// CaptionUpdate turns the caption line of sentence Index last sent into
+// its first Keep runes followed by Append. The first Committed runes of
+// the new line will not change again before the final update.
+type CaptionUpdate struct {
+	Index     int
+	Keep      int
+	Append    string
+	Committed int
+	Final     bool
+}
+
+// ApplyCaptionUpdate returns the line after update, prev is the line of
+// the same sentence before it, empty for a new sentence.
+func ApplyCaptionUpdate(prev string, update CaptionUpdate) string {
+	runes := []rune(prev)
+	if update.Keep < len(runes) {
+		runes = runes[:update.Keep]
+	}
+	return string(runes) + update.Append
+}
+
+func commonPrefix(a []rune, b []rune) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// CaptionStabilizer turns the partial and final results of a
+// SpeechTranscription into flicker free caption updates. The committed
+// prefix of a sentence only grows, later partials that disagree with it
+// only change the volatile tail until SentenceEnd replaces the line.
+type CaptionStabilizer struct {
+	Stability CaptionStability
+	//partial updates closer than this are merged, 0 sends every change.
+	//Final updates are never delayed.
+	MinInterval time.Duration
+
+	onUpdate func(update CaptionUpdate)
+
+	lk        sync.Mutex
+	index     int
+	partials  []string
+	committed []rune
+	line      []rune
+
+	//what the client has seen
+	sentIndex     int
+	sentLine      []rune
+	sentCommitted int
+	lastSent      time.Time
+	timer         *time.Timer
+	closed        bool
+}
+
+// onUpdate is called with the stabilizer locked, in order, and must not
+// call back into it.
+func NewCaptionStabilizer(onUpdate func(update CaptionUpdate)) *CaptionStabilizer {
+	c := new(CaptionStabilizer)
+	c.Stability = StableAfterUpdates(DEFAULT_CAPTION_STABLE_UPDATES)
+	c.onUpdate = onUpdate
+	c.sentIndex = -1
+	return c
+}
+
+func parseCaption(text string) (int, string, bool) {
+	resp := CommonResponse{}
+	err := json.Unmarshal([]byte(text), &resp)
+	if err != nil {
+		return 0, "", false
+	}
+	result, _ := resp.Payload["result"].(string)
+	index, _ := resp.Payload["index"].(float64)
+	return int(index), result, true
+}
+
+// ResultChanged and SentenceEnd have the signature of the
+// SpeechTranscription callbacks and can be passed to it directly.
+func (c *CaptionStabilizer) ResultChanged(text string, param interface{}) {
+	index, result, ok := parseCaption(text)
+	if ok {
+		c.Partial(index, result)
+	}
+}
+
+func (c *CaptionStabilizer) SentenceEnd(text string, param interface{}) {
+	index, result, ok := parseCaption(text)
+	if ok {
+		c.Final(index, result)
+	}
+}
+
+// Feed takes an event of SpeechTranscription.Events, the end of the
+// session flushes a merged partial.
+func (c *CaptionStabilizer) Feed(ev TranscriptionEvent) {
+	switch ev.Type {
+	case TRANSCRIPTION_PARTIAL:
+		c.ResultChanged(ev.Text, nil)
+	case TRANSCRIPTION_SENTENCE_END:
+		c.SentenceEnd(ev.Text, nil)
+	case TRANSCRIPTION_COMPLETED, TRANSCRIPTION_FAILED, TRANSCRIPTION_CLOSED:
+		c.Flush()
+	}
+}
+
+// Run feeds events until the channel is closed.
+func (c *CaptionStabilizer) Run(events <-chan TranscriptionEvent) {
+	for ev := range events {
+		c.Feed(ev)
+	}
+	c.Flush()
+}
+
+func (c *CaptionStabilizer) Partial(index int, text string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return
+	}
+
+	if index != c.index {
+		c.reset(index)
+	}
+	c.partials = append(c.partials, text)
+	if len(c.partials) > captionHistory {
+		c.partials = c.partials[len(c.partials)-captionHistory:]
+	}
+
+	runes := []rune(text)
+	stable := c.Stability(c.partials)
+	if stable > len(runes) {
+		stable = len(runes)
+	}
+	if stable > len(c.committed) && commonPrefix(c.committed, runes) == len(c.committed) {
+		c.committed = runes[:stable]
+	}
+
+	//the committed prefix stays even if the partial disagrees with it,
+	//then the partial only contributes what lies beyond its length
+	var tail []rune
+	if len(runes) > len(c.committed) {
+		tail = runes[len(c.committed):]
+	}
+	c.line = append(append([]rune{}, c.committed...), tail...)
+	c.schedule()
+}
+
+func (c *CaptionStabilizer) Final(index int, text string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return
+	}
+
+	if index != c.index {
+		c.reset(index)
+	}
+	c.line = []rune(text)
+	c.committed = c.line
+	c.send(true)
+	c.reset(index + 1)
+}
+
+// Flush sends a merged partial now.
+func (c *CaptionStabilizer) Flush() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return
+	}
+	c.send(false)
+}
+
+// Close flushes and drops everything fed afterwards.
+func (c *CaptionStabilizer) Close() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return
+	}
+	c.send(false)
+	c.closed = true
+}
+
+func (c *CaptionStabilizer) reset(index int) {
+	c.index = index
+	c.partials = nil
+	c.committed = nil
+	c.line = nil
+}
+
+func (c *CaptionStabilizer) schedule() {
+	if c.MinInterval <= 0 {
+		c.send(false)
+		return
+	}
+	wait := c.MinInterval - time.Since(c.lastSent)
+	if wait <= 0 {
+		c.send(false)
+		return
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(wait, c.Flush)
+	}
+}
+
+// send diffs the line against what the client has seen
+func (c *CaptionStabilizer) send(final bool) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	keep := 0
+	if c.sentIndex == c.index {
+		keep = commonPrefix(c.sentLine, c.line)
+		if !final && keep == len(c.sentLine) && keep == len(c.line) && c.sentCommitted == len(c.committed) {
+			return
+		}
+	} else if !final && len(c.line) == 0 {
+		return
+	}
+
+	update := CaptionUpdate{
+		Index:     c.index,
+		Keep:      keep,
+		Append:    string(c.line[keep:]),
+		Committed: len(c.committed),
+		Final:     final,
+	}
+	c.sentIndex = c.index
+	c.sentLine = c.line
+	c.sentCommitted = len(c.committed)
+	c.lastSent = time.Now()
+	if c.onUpdate != nil {
+		c.onUpdate(update)
+	}
+}
@@ -0,0 +1,358 @@
+/*
+client.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrClientClosed = errors.New("client closed")
+
+type ClientStats struct {
+	//sessions with a running task or an open connection of their own
+	Sessions int
+	Running  int
+	//tasks since the client was created
+	Started   int64
+	Completed int64
+	Failed    int64
+}
+
+type clientSession struct {
+	running bool
+	started time.Time
+}
+
+// Client owns the config, credentials and logger shared by the sessions
+// it creates, tracks them and drains them on Close. Endpoints, Retry and
+// Limiter are taken from the config.
+type Client struct {
+	//called before a task starts when the token of the config is empty or
+	//expires within 5 minutes, an expireTime of 0 asks again before every
+	//task. Nil refreshes with akid/akkey of the config when set.
+	TokenProvider func() (token string, expireTime int64, err error)
+
+	//metrics hooks, called from the session goroutines and must not block.
+	//service is the namespace, e.g. ST_NAMESPACE
+	OnTaskStart func(service string)
+	OnTaskEnd   func(service string, duration time.Duration, completed bool)
+
+	config *ConnectionConfig
+	logger *NlsLogger
+
+	tokenLk  sync.Mutex
+	lk       sync.Mutex
+	defaults map[string]map[string]interface{}
+	sessions map[*nlsProto]*clientSession
+	closed   bool
+	stats    ClientStats
+}
+
+func NewClient(config *ConnectionConfig, logger *NlsLogger) (*Client, error) {
+	if config == nil {
+		return nil, errors.New("empty connection config")
+	}
+	if logger == nil {
+		logger = DefaultNlsLog()
+	}
+
+	c := new(Client)
+	c.config = config
+	c.logger = logger
+	c.defaults = make(map[string]map[string]interface{})
+	c.sessions = make(map[*nlsProto]*clientSession)
+	return c, nil
+}
+
+func (c *Client) Config() *ConnectionConfig {
+	return c.config
+}
+
+func (c *Client) Logger() *NlsLogger {
+	return c.logger
+}
+
+// SetDefaults sets start parameters of service, e.g. a vocabulary_id for
+// ST_NAMESPACE. They only fill keys left out by the params of Start and
+// are overridden by its extra.
+func (c *Client) SetDefaults(service string, extra map[string]interface{}) {
+	defaults := make(map[string]interface{}, len(extra))
+	for k, v := range extra {
+		defaults[k] = v
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.defaults[service] = defaults
+}
+
+func (c *Client) defaultsOf(service string) map[string]interface{} {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.defaults[service]
+}
+
+func (c *Client) adopt(nls *nlsProto) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+	nls.client = c
+	return nil
+}
+
+func (c *Client) NewSpeechRecognition(
+	taskfailed func(string, interface{}),
+	started func(string, interface{}),
+	resultchanged func(string, interface{}),
+	completed func(string, interface{}),
+	closed func(interface{}),
+	param interface{}) (*SpeechRecognition, error) {
+	sr, err := NewSpeechRecognition(c.config, c.logger,
+		taskfailed, started, resultchanged, completed, closed, param)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.adopt(sr.nls); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+func (c *Client) NewSpeechTranscription(
+	taskfailed func(string, interface{}),
+	started func(string, interface{}),
+	sentencebegin func(string, interface{}),
+	sentenceend func(string, interface{}),
+	resultchanged func(string, interface{}),
+	completed func(string, interface{}),
+	closed func(interface{}),
+	param interface{}) (*SpeechTranscription, error) {
+	st, err := NewSpeechTranscription(c.config, c.logger,
+		taskfailed, started, sentencebegin, sentenceend, resultchanged, completed, closed, param)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.adopt(st.nls); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (c *Client) NewSpeechSynthesis(realtimeLongText bool,
+	taskfailed func(string, interface{}),
+	synthesisresult func([]byte, interface{}),
+	metainfo func(string, interface{}),
+	completed func(string, interface{}),
+	closed func(interface{}),
+	param interface{}) (*SpeechSynthesis, error) {
+	tts, err := NewSpeechSynthesis(c.config, c.logger, realtimeLongText,
+		taskfailed, synthesisresult, metainfo, completed, closed, param)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.adopt(tts.nls); err != nil {
+		return nil, err
+	}
+	return tts, nil
+}
+
+func (c *Client) NewFlowingSpeechSynthesis(
+	taskfailed func(string, interface{}),
+	started func(string, interface{}),
+	sentencebegin func(string, interface{}),
+	sentencesynthesis func(string, interface{}),
+	sentenceend func(string, interface{}),
+	synthesisresult func([]byte, interface{}),
+	completed func(string, interface{}),
+	closed func(interface{}),
+	param interface{}) (*FlowingSpeechSynthesis, error) {
+	fss, err := NewFlowingSpeechSynthesis(c.config, c.logger,
+		taskfailed, started, sentencebegin, sentencesynthesis, sentenceend, synthesisresult, completed, closed, param)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.adopt(fss.nls); err != nil {
+		return nil, err
+	}
+	return fss, nil
+}
+
+func (c *Client) refreshToken() error {
+	if c.TokenProvider == nil && (c.config.Akid == "" || c.config.Akkey == "") {
+		return nil
+	}
+
+	c.tokenLk.Lock()
+	defer c.tokenLk.Unlock()
+	expire := c.config.tokenExpireTime()
+	if c.config.token() != "" && !expire.IsZero() && time.Until(expire) > endpointTokenMargin {
+		return nil
+	}
+
+	if c.TokenProvider == nil {
+		if c.config.token() != "" && expire.IsZero() {
+			return nil
+		}
+		return refreshConfigToken(c.config)
+	}
+	token, expireTime, err := c.TokenProvider()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("token provider returned empty token")
+	}
+	c.config.setToken(token, expireTime)
+	c.logger.setRedactSecret(redactSlot(c.config, "token"), token)
+	return nil
+}
+
+// called by startTask before a task of nls starts
+func (c *Client) taskStarted(nls *nlsProto) error {
+	c.lk.Lock()
+	closed := c.closed
+	c.lk.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+
+	err := c.refreshToken()
+	if err != nil {
+		return err
+	}
+
+	c.lk.Lock()
+	if c.closed {
+		c.lk.Unlock()
+		return ErrClientClosed
+	}
+	c.prune()
+	c.sessions[nls] = &clientSession{running: true, started: time.Now()}
+	c.stats.Started++
+	c.lk.Unlock()
+
+	if c.OnTaskStart != nil {
+		c.OnTaskStart(nls.proto.namespace)
+	}
+	return nil
+}
+
+func (c *Client) taskEnded(nls *nlsProto, completed bool) {
+	c.lk.Lock()
+	s, ok := c.sessions[nls]
+	if !ok || !s.running {
+		c.lk.Unlock()
+		return
+	}
+	s.running = false
+	duration := time.Since(s.started)
+	if completed {
+		c.stats.Completed++
+	} else {
+		c.stats.Failed++
+	}
+	c.lk.Unlock()
+
+	if c.OnTaskEnd != nil {
+		c.OnTaskEnd(nls.proto.namespace, duration, completed)
+	}
+}
+
+// drop the sessions that neither run a task nor hold a connection, must
+// be called with c.lk held
+func (c *Client) prune() {
+	for nls, s := range c.sessions {
+		if !s.running && !nls.connOpen() {
+			delete(c.sessions, nls)
+		}
+	}
+}
+
+func (c *Client) Stats() ClientStats {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.prune()
+	stats := c.stats
+	stats.Sessions = len(c.sessions)
+	for _, s := range c.sessions {
+		if s.running {
+			stats.Running++
+		}
+	}
+	return stats
+}
+
+func drainSession(ctx context.Context, nls *nlsProto) (bool, error) {
+	switch s := nls.param.(type) {
+	case *SpeechRecognition:
+		return s.ShutdownContext(ctx, true)
+	case *SpeechTranscription:
+		return s.ShutdownContext(ctx, true)
+	case *FlowingSpeechSynthesis:
+		return s.ShutdownContext(ctx, true)
+	case *SpeechSynthesis:
+		return s.ShutdownContext(ctx)
+	default:
+		return false, errors.New("unknown session type")
+	}
+}
+
+// Close refuses new sessions and tasks, then shuts every session down
+// with ShutdownContext in parallel: running tasks are stopped and their
+// final results awaited until ctx is done, after that they are torn down.
+// It returns the first error, ctx.Err() if the deadline cut a task short.
+func (c *Client) Close(ctx context.Context) error {
+	c.lk.Lock()
+	c.closed = true
+	c.prune()
+	live := make([]*nlsProto, 0, len(c.sessions))
+	for nls := range c.sessions {
+		live = append(live, nls)
+	}
+	c.lk.Unlock()
+
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	var first error
+	for _, nls := range live {
+		wg.Add(1)
+		go func(nls *nlsProto) {
+			defer wg.Done()
+			_, err := drainSession(ctx, nls)
+			if err != nil {
+				lk.Lock()
+				if first == nil {
+					first = err
+				}
+				lk.Unlock()
+			}
+		}(nls)
+	}
+	wg.Wait()
+
+	c.lk.Lock()
+	c.prune()
+	c.lk.Unlock()
+	return first
+}
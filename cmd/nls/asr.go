@@ -0,0 +1,219 @@
+/*
+asr.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aliyun/alibabacloud-nls-go-sdk"
+)
+
+type asrFlags struct {
+	commonFlags
+	input      string
+	output     string
+	format     string
+	sampleRate int
+	speed      float64
+	timeout    time.Duration
+}
+
+func (a *asrFlags) register(fs *flag.FlagSet) {
+	a.commonFlags.register(fs)
+	fs.StringVar(&a.input, "i", "-", "audio file, - for stdin")
+	fs.StringVar(&a.output, "output", "text", "result format: text, jsonl or srt")
+	fs.StringVar(&a.format, "format", nls.PCM, "audio format")
+	fs.IntVar(&a.sampleRate, "sample-rate", 16000, "sample rate of the audio")
+	fs.Float64Var(&a.speed, "speed", 1, "send audio at this multiple of real time, 0 for no pacing")
+	fs.DurationVar(&a.timeout, "timeout", 60*time.Second, "wait for the server at most this long")
+}
+
+// waits for a Start/Stop channel, the server reason comes from lastErr
+func waitResult(ch chan bool, timeout time.Duration, lastErr func() error) error {
+	select {
+	case ok := <-ch:
+		if ok {
+			return nil
+		}
+		if err := lastErr(); err != nil {
+			return err
+		}
+		return errors.New("task failed")
+	case <-time.After(timeout):
+		return errors.New("wait timeout")
+	}
+}
+
+func runRecognize(args []string) error {
+	var flags asrFlags
+	fs := flag.NewFlagSet("recognize", flag.ExitOnError)
+	flags.register(fs)
+	partial := fs.Bool("partial", false, "also print intermediate results")
+	fs.Parse(args)
+
+	out, err := newResultWriter(flags.output, os.Stdout, *partial)
+	if err != nil {
+		return err
+	}
+	config, err := connectionConfig(&flags.commonFlags)
+	if err != nil {
+		return err
+	}
+	in, err := openInput(flags.input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var final segment
+	sr, err := nls.NewSpeechRecognition(config, newLogger(&flags.commonFlags), nil, nil,
+		func(text string, param interface{}) {
+			if seg, err := parseSegment(text, SEGMENT_PARTIAL); err == nil {
+				out.write(seg)
+			}
+		},
+		func(text string, param interface{}) {
+			final, _ = parseSegment(text, SEGMENT_FINAL)
+		}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer sr.Shutdown()
+
+	param := nls.DefaultSpeechRecognitionParam()
+	param.Format = flags.format
+	param.SampleRate = flags.sampleRate
+	param.EnableIntermediateResult = nls.Bool(*partial)
+	ch, err := sr.Start(param, nil)
+	if err != nil {
+		return err
+	}
+	err = waitResult(ch, flags.timeout, sr.LastError)
+	if err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+
+	duration, err := sendAudio(in, flags.sampleRate, 100, flags.speed, sr.SendAudioData)
+	if err != nil {
+		return err
+	}
+
+	ch, err = sr.Stop()
+	if err != nil {
+		return err
+	}
+	err = waitResult(ch, flags.timeout, sr.LastError)
+	if err != nil {
+		return fmt.Errorf("stop: %w", err)
+	}
+
+	//the completed message carries no times, the sentence spans the audio
+	final.End = duration
+	return out.write(final)
+}
+
+func runTranscribe(args []string) error {
+	var flags asrFlags
+	fs := flag.NewFlagSet("transcribe", flag.ExitOnError)
+	flags.register(fs)
+	partial := fs.Bool("partial", false, "also print intermediate results")
+	silence := fs.Int("max-sentence-silence", 0, "silence in ms that ends a sentence, 0 for the server default")
+	fs.Parse(args)
+
+	out, err := newResultWriter(flags.output, os.Stdout, *partial)
+	if err != nil {
+		return err
+	}
+	config, err := connectionConfig(&flags.commonFlags)
+	if err != nil {
+		return err
+	}
+	in, err := openInput(flags.input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	st, err := nls.NewSpeechTranscription(config, newLogger(&flags.commonFlags),
+		nil, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer st.Shutdown()
+
+	//a slow stdout must hold the session up, not lose sentences of the
+	//transcript
+	st.SetEventOption(nls.DEFAULT_EVENT_BUFFER, nls.EVENT_OVERFLOW_BLOCK)
+	events := st.Events()
+	written := make(chan error, 1)
+	go func() {
+		var werr error
+		for ev := range events {
+			var seg segment
+			var err error
+			switch ev.Type {
+			case nls.TRANSCRIPTION_PARTIAL:
+				seg, err = parseSegment(ev.Text, SEGMENT_PARTIAL)
+			case nls.TRANSCRIPTION_SENTENCE_END:
+				seg, err = parseSegment(ev.Text, SEGMENT_FINAL)
+			default:
+				continue
+			}
+			if err == nil && werr == nil {
+				werr = out.write(seg)
+			}
+		}
+		written <- werr
+	}()
+
+	param := nls.DefaultSpeechTranscriptionParam()
+	param.Format = flags.format
+	param.SampleRate = flags.sampleRate
+	param.EnableIntermediateResult = nls.Bool(*partial)
+	if *silence > 0 {
+		param.MaxSentenceSilence = nls.Int(*silence)
+	}
+	ch, err := st.Start(param, nil)
+	if err != nil {
+		return err
+	}
+	err = waitResult(ch, flags.timeout, st.LastError)
+	if err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+
+	_, err = sendAudio(in, flags.sampleRate, 100, flags.speed, st.SendAudioData)
+	if err != nil {
+		return err
+	}
+
+	ch, err = st.Stop()
+	if err != nil {
+		return err
+	}
+	err = waitResult(ch, flags.timeout, st.LastError)
+	if err != nil {
+		return fmt.Errorf("stop: %w", err)
+	}
+	return <-written
+}
@@ -0,0 +1,68 @@
+/*
+audio.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+// bytes per ms of 16 bit mono pcm
+func pcmBytesPerMs(sampleRate int) int {
+	return sampleRate * 2 / 1000
+}
+
+// sendAudio feeds r to send in chunks of chunkMs, paced at speed times real
+// time, speed 0 sends as fast as possible. Returns the audio duration in ms.
+func sendAudio(r io.Reader, sampleRate int, chunkMs int, speed float64, send func([]byte) error) (int, error) {
+	chunk := make([]byte, pcmBytesPerMs(sampleRate)*chunkMs)
+	total := 0
+	start := time.Now()
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if serr := send(chunk[:n]); serr != nil {
+				return total / pcmBytesPerMs(sampleRate), serr
+			}
+			total += n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return total / pcmBytesPerMs(sampleRate), err
+		}
+
+		if speed > 0 {
+			sent := time.Duration(float64(total/pcmBytesPerMs(sampleRate))/speed) * time.Millisecond
+			if wait := sent - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+	return total / pcmBytesPerMs(sampleRate), nil
+}
@@ -0,0 +1,205 @@
+/*
+config.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aliyun/alibabacloud-nls-go-sdk"
+)
+
+// same keys as nls.NewConnectionConfigFromJson
+type cliConfig struct {
+	Url    string `json:"url"`
+	Appkey string `json:"appkey"`
+	Token  string `json:"token"`
+	Akid   string `json:"akid"`
+	Akkey  string `json:"akkey"`
+}
+
+type commonFlags struct {
+	config string
+	debug  bool
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.config, "config", "", "config file, default $NLS_CONFIG or ~/.nls/config.json")
+	fs.BoolVar(&c.debug, "debug", false, "print sdk logs to stderr")
+}
+
+func nlsDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".nls"
+	}
+	return filepath.Join(home, ".nls")
+}
+
+func loadConfig(path string) (*cliConfig, error) {
+	config := new(cliConfig)
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("NLS_CONFIG")
+		explicit = path != ""
+	}
+	if path == "" {
+		path = filepath.Join(nlsDir(), "config.json")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, config)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	} else if explicit || !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for env, field := range map[string]*string{
+		"NLS_URL":    &config.Url,
+		"NLS_APPKEY": &config.Appkey,
+		"NLS_TOKEN":  &config.Token,
+		"NLS_AKID":   &config.Akid,
+		"NLS_AKKEY":  &config.Akkey,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*field = v
+		}
+	}
+	if config.Url == "" {
+		config.Url = nls.DEFAULT_URL
+	}
+	return config, nil
+}
+
+type cachedToken struct {
+	Akid string `json:"akid"`
+	//token domain of the region it was obtained for
+	Domain     string `json:"domain"`
+	Token      string `json:"token"`
+	ExpireTime int64  `json:"expire_time"`
+}
+
+// tokens are reused until ten minutes before they expire
+const tokenCacheMargin = 10 * time.Minute
+
+func tokenCachePath() string {
+	return filepath.Join(nlsDir(), "token.json")
+}
+
+func readCachedToken(akid string, domain string) *cachedToken {
+	b, err := ioutil.ReadFile(tokenCachePath())
+	if err != nil {
+		return nil
+	}
+	cached := new(cachedToken)
+	if json.Unmarshal(b, cached) != nil || cached.Akid != akid || cached.Domain != domain || cached.Token == "" {
+		return nil
+	}
+	if time.Until(time.Unix(cached.ExpireTime, 0)) < tokenCacheMargin {
+		return nil
+	}
+	return cached
+}
+
+func writeCachedToken(cached *cachedToken) error {
+	err := os.MkdirAll(nlsDir(), 0700)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tokenCachePath(), b, 0600)
+}
+
+// token of config, or one fetched with akid/akkey and cached on disk
+func resolveToken(config *cliConfig, refresh bool) (*cachedToken, error) {
+	if config.Token != "" && !refresh {
+		return &cachedToken{Token: config.Token}, nil
+	}
+	if config.Akid == "" || config.Akkey == "" {
+		return nil, errors.New("no credentials: set NLS_TOKEN or NLS_AKID and NLS_AKKEY, or write them to the config file")
+	}
+
+	//the region of the gateway in the url, as the sdk does when refreshing
+	region, domain := (&nls.ConnectionConfig{Url: config.Url}).TokenLocation()
+	if !refresh {
+		if cached := readCachedToken(config.Akid, domain); cached != nil {
+			return cached, nil
+		}
+	}
+
+	msg, err := nls.GetToken(region, domain, config.Akid, config.Akkey, nls.DEFAULT_VERSION)
+	if err != nil {
+		return nil, err
+	}
+	if msg.TokenResult.Id == "" {
+		return nil, fmt.Errorf("obtain empty token err:%s", msg.ErrMsg)
+	}
+
+	cached := &cachedToken{
+		Akid:       config.Akid,
+		Domain:     domain,
+		Token:      msg.TokenResult.Id,
+		ExpireTime: msg.TokenResult.ExpireTime,
+	}
+	err = writeCachedToken(cached)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nls: token not cached:", err)
+	}
+	return cached, nil
+}
+
+func connectionConfig(flags *commonFlags) (*nls.ConnectionConfig, error) {
+	config, err := loadConfig(flags.config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Appkey == "" {
+		return nil, errors.New("no appkey: set NLS_APPKEY or appkey in the config file")
+	}
+	token, err := resolveToken(config, false)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := nls.NewConnectionConfigWithToken(config.Url, config.Appkey, token.Token)
+	conn.Akid = config.Akid
+	conn.Akkey = config.Akkey
+	conn.TokenExpireTime = token.ExpireTime
+	return conn, nil
+}
+
+func newLogger(flags *commonFlags) *nls.NlsLogger {
+	logger := nls.NewNlsLogger(os.Stderr, "NLS ", log.LstdFlags|log.Lmicroseconds)
+	logger.SetLogSil(!flags.debug)
+	logger.SetDebug(flags.debug)
+	return logger
+}
@@ -0,0 +1,76 @@
+/*
+main.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// nls is a command line client of the speech services:
+//
+//	nls token [-refresh]
+//	nls recognize  [-i audio.pcm|-] [-output text|jsonl|srt]
+//	nls transcribe [-i audio.pcm|-] [-output text|jsonl|srt] [-partial]
+//	nls synthesize [-text TEXT|-i text.txt|-] -o out.wav
+//
+// Credentials come from NLS_URL, NLS_APPKEY, NLS_TOKEN, NLS_AKID and
+// NLS_AKKEY, or from the json config file given by -config or NLS_CONFIG,
+// ~/.nls/config.json by default. Environment wins over the file.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: nls <command> [flags]
+
+commands:
+  token       fetch a token with akid/akkey and cache it
+  recognize   one-sentence recognition of an audio file or stdin
+  transcribe  realtime transcription of an audio file or stdin
+  synthesize  text to speech into an audio file
+
+run "nls <command> -h" for the flags of a command
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "token":
+		err = runToken(args)
+	case "recognize":
+		err = runRecognize(args)
+	case "transcribe":
+		err = runTranscribe(args)
+	case "synthesize":
+		err = runSynthesize(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nls:", err)
+		os.Exit(1)
+	}
+}
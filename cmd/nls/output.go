@@ -0,0 +1,129 @@
+/*
+output.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aliyun/alibabacloud-nls-go-sdk"
+)
+
+const (
+	SEGMENT_PARTIAL = "partial"
+	SEGMENT_FINAL   = "final"
+)
+
+// one recognized piece of text, times in ms from the start of the audio
+type segment struct {
+	Type   string `json:"type"`
+	TaskId string `json:"task_id,omitempty"`
+	Index  int    `json:"index,omitempty"`
+	Begin  int    `json:"begin_time"`
+	End    int    `json:"end_time"`
+	Text   string `json:"text"`
+}
+
+type resultWriter interface {
+	write(seg segment) error
+}
+
+func newResultWriter(format string, w io.Writer, partial bool) (resultWriter, error) {
+	switch format {
+	case "text", "":
+		return &textWriter{w: w, partial: partial}, nil
+	case "jsonl":
+		return &jsonlWriter{enc: json.NewEncoder(w), partial: partial}, nil
+	case "srt":
+		return &srtWriter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown output %q, expect text, jsonl or srt", format)
+	}
+}
+
+type textWriter struct {
+	w       io.Writer
+	partial bool
+}
+
+func (t *textWriter) write(seg segment) error {
+	if seg.Type == SEGMENT_PARTIAL {
+		if !t.partial {
+			return nil
+		}
+		_, err := fmt.Fprintln(t.w, "...", seg.Text)
+		return err
+	}
+	_, err := fmt.Fprintln(t.w, seg.Text)
+	return err
+}
+
+type jsonlWriter struct {
+	enc     *json.Encoder
+	partial bool
+}
+
+func (j *jsonlWriter) write(seg segment) error {
+	if seg.Type == SEGMENT_PARTIAL && !j.partial {
+		return nil
+	}
+	return j.enc.Encode(seg)
+}
+
+type srtWriter struct {
+	w   io.Writer
+	seq int
+}
+
+func srtTime(ms int) string {
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func (s *srtWriter) write(seg segment) error {
+	if seg.Type != SEGMENT_FINAL || strings.TrimSpace(seg.Text) == "" {
+		return nil
+	}
+	s.seq++
+	_, err := fmt.Fprintf(s.w, "%d\n%s --> %s\n%s\n\n", s.seq, srtTime(seg.Begin), srtTime(seg.End), seg.Text)
+	return err
+}
+
+// segment from a server message, result and times live in the payload
+func parseSegment(text string, segType string) (segment, error) {
+	resp := nls.CommonResponse{}
+	err := json.Unmarshal([]byte(text), &resp)
+	if err != nil {
+		return segment{}, err
+	}
+
+	seg := segment{Type: segType, TaskId: resp.Header.TaskId}
+	seg.Text, _ = resp.Payload["result"].(string)
+	if v, ok := resp.Payload["index"].(float64); ok {
+		seg.Index = int(v)
+	}
+	if v, ok := resp.Payload["begin_time"].(float64); ok {
+		seg.Begin = int(v)
+	}
+	if v, ok := resp.Payload["time"].(float64); ok {
+		seg.End = int(v)
+	}
+	return seg, nil
+}
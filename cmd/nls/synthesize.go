@@ -0,0 +1,117 @@
+/*
+synthesize.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aliyun/alibabacloud-nls-go-sdk"
+)
+
+func runSynthesize(args []string) error {
+	var flags commonFlags
+	fs := flag.NewFlagSet("synthesize", flag.ExitOnError)
+	flags.register(fs)
+	text := fs.String("text", "", "text to synthesize, read from -i when empty")
+	input := fs.String("i", "-", "text file, - for stdin")
+	output := fs.String("o", "", "audio output file, - for stdout")
+	voice := fs.String("voice", "xiaoyun", "voice")
+	format := fs.String("format", nls.WAV, "audio format: wav, pcm or mp3")
+	sampleRate := fs.Int("sample-rate", 16000, "sample rate")
+	volume := fs.Int("volume", -1, "volume 0-100, server default when unset")
+	speechRate := fs.Int("speech-rate", 0, "speech rate -500-500")
+	pitchRate := fs.Int("pitch-rate", 0, "pitch rate -500-500")
+	long := fs.Bool("long", false, "use the long text synthesizer")
+	timeout := fs.Duration("timeout", 60*time.Second, "wait for the audio at most this long")
+	fs.Parse(args)
+
+	if *output == "" {
+		return errors.New("missing -o")
+	}
+	if *text == "" {
+		in, err := openInput(*input)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+		*text = strings.TrimSpace(string(b))
+	}
+	if *text == "" {
+		return errors.New("nothing to synthesize")
+	}
+
+	config, err := connectionConfig(&flags)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var werr error
+	tts, err := nls.NewSpeechSynthesis(config, newLogger(&flags), *long, nil,
+		func(data []byte, param interface{}) {
+			if werr == nil {
+				_, werr = w.Write(data)
+			}
+		}, nil, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer tts.Shutdown()
+
+	param := nls.DefaultSpeechSynthesisParam()
+	param.Voice = *voice
+	param.Format = *format
+	param.SampleRate = *sampleRate
+	param.Volume = nil
+	if *volume >= 0 {
+		param.Volume = nls.Int(*volume)
+	}
+	param.SpeechRate = nls.Int(*speechRate)
+	param.PitchRate = nls.Int(*pitchRate)
+	ch, err := tts.Start(*text, param, nil)
+	if err != nil {
+		return err
+	}
+
+	err = waitResult(ch, *timeout, tts.LastError)
+	if err != nil {
+		return fmt.Errorf("synthesize: %w", err)
+	}
+	return werr
+}
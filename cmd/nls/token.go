@@ -0,0 +1,61 @@
+/*
+token.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func runToken(args []string) error {
+	var flags commonFlags
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	flags.register(fs)
+	refresh := fs.Bool("refresh", false, "ignore the cached token")
+	asJson := fs.Bool("json", false, "print token and expire time as json")
+	fs.Parse(args)
+
+	config, err := loadConfig(flags.config)
+	if err != nil {
+		return err
+	}
+	//an explicit token needs no fetching, use akid/akkey when asked to refresh
+	if *refresh {
+		config.Token = ""
+	}
+	token, err := resolveToken(config, *refresh)
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"token":       token.Token,
+			"expire_time": token.ExpireTime,
+		})
+	}
+	fmt.Println(token.Token)
+	if token.ExpireTime != 0 {
+		fmt.Fprintln(os.Stderr, "expires at", time.Unix(token.ExpireTime, 0).Format(time.RFC3339))
+	}
+	return nil
+}
@@ -19,9 +19,11 @@ limitations under the License.
 package nls
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -29,6 +31,9 @@ const (
 	CONNECTED_HANDLER = "CONNECTED_HANDLER"
 	CLOSE_HANDLER     = "CLOSE_HANDLER"
 	RAW_HANDLER       = "RAW_HANDLER"
+
+	//bounds the close handshake of ShutdownContext
+	DEFAULT_CLOSE_TIMEOUT = 2 * time.Second
 )
 
 type ConnectionConfig struct {
@@ -39,21 +44,56 @@ type ConnectionConfig struct {
 	Appkey  string `json:"appkey"`
 	Rbuffer int    `json:"rbuffer"`
 	Wbuffer int    `json:"wbuffer"`
+	//unix seconds, 0 when unknown
+	TokenExpireTime int64 `json:"token_expire_time,omitempty"`
+
+	//ordered candidates tried on Connect, Url is used alone when empty
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+
+	//nil keeps the legacy behaviour: no retry once the dial succeeded
+	Retry *RetryPolicy `json:"-"`
+	//shared by every config that should count against the same quota
+	Limiter *RateLimiter `json:"-"`
+
+	pool *endpointPool
+}
+
+// guards Token of every config, tokens are refreshed by retrying sessions
+// while others read them
+var configTokenLk sync.RWMutex
+
+func (config *ConnectionConfig) token() string {
+	configTokenLk.RLock()
+	defer configTokenLk.RUnlock()
+	return config.Token
+}
+
+func (config *ConnectionConfig) setToken(token string, expireTime int64) {
+	configTokenLk.Lock()
+	defer configTokenLk.Unlock()
+	config.Token = token
+	config.TokenExpireTime = expireTime
+}
+
+func (config *ConnectionConfig) tokenExpireTime() time.Time {
+	configTokenLk.RLock()
+	defer configTokenLk.RUnlock()
+	if config.TokenExpireTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(config.TokenExpireTime, 0)
 }
 
 func NewConnectionConfigWithAKInfoDefault(url string, appkey string,
 	akid string, akkey string) (*ConnectionConfig, error) {
-	tokenMsg, err := GetToken(DEFAULT_DISTRIBUTE, DEFAULT_DOMAIN, akid, akkey, DEFAULT_VERSION)
+	config := NewConnectionConfigWithToken(url, appkey, "")
+	config.Akid = akid
+	config.Akkey = akkey
+	err := refreshConfigToken(config)
 	if err != nil {
 		return nil, err
 	}
-
-	if tokenMsg.TokenResult.Id == "" {
-		str := fmt.Sprintf("obtain empty token err:%s", tokenMsg.ErrMsg)
-		return nil, errors.New(str)
-	}
-
-	return NewConnectionConfigWithToken(url, appkey, tokenMsg.TokenResult.Id), nil
+	return config, nil
 }
 
 func NewConnectionConfigWithToken(url string, appkey string, token string) *ConnectionConfig {
@@ -73,18 +113,33 @@ func NewConnectionConfigFromJson(jsonStr string) (*ConnectionConfig, error) {
 		return nil, err
 	}
 
-	if config.Url == "" || config.Appkey == "" {
+	if (config.Url == "" && len(config.Endpoints) == 0) || config.Appkey == "" {
 		return nil, errors.New("invalid connection config: no url or appkey")
 	}
+	if config.Url == "" {
+		config.Url = config.Endpoints[0].Url
+	}
+
+	if config.Token == "" && (config.Akid == "" || config.Akkey == "") {
+		return nil, errors.New("invalid connection config: if no token provided, must provide akid and akkey")
+	}
 
-	if config.Token == "" {
-		if config.Akid == "" || config.Akkey == "" {
-			return nil, errors.New("invalid connection config: if no token provided, must provide akid and akkey")
+	//akid/akkey next to a token keep it refreshable, endpoints are set
+	//first so that the token comes from where they point
+	result := NewConnectionConfigWithToken(config.Url, config.Appkey, config.Token)
+	result.TokenExpireTime = config.TokenExpireTime
+	result.Endpoints = config.Endpoints
+	if config.Akid != "" && config.Akkey != "" {
+		result.Akid = config.Akid
+		result.Akkey = config.Akkey
+	}
+	if result.Token == "" {
+		err = refreshConfigToken(result)
+		if err != nil {
+			return nil, err
 		}
-		return NewConnectionConfigWithAKInfoDefault(config.Url, config.Appkey, config.Akid, config.Akkey)
-	} else {
-		return NewConnectionConfigWithToken(config.Url, config.Appkey, config.Token), nil
 	}
+	return result, nil
 }
 
 type nlsProto struct {
@@ -94,6 +149,30 @@ type nlsProto struct {
 	logger     *NlsLogger
 	taskId     string
 	param      interface{}
+
+	lk sync.Mutex
+	//bumped on every dial, frames from an older connection are dropped
+	connSeq uint64
+	//bumped to abandon a background start retry
+	retrySeq uint64
+	//a background start retry is scheduled or dialing
+	retrying bool
+	attempt  int
+	newTask  func() string
+	//url of the endpoint serving the current connection
+	endpoint string
+	source   connSource
+	recorder *SessionRecorder
+	//gives back the slot of the rate limiter held by the current task
+	limitRelease func()
+	//closed once the current task is over, taskFinal tells whether the
+	//server completed it
+	taskEnd   chan struct{}
+	taskFinal bool
+	//set by taskDone, the frame being handled ends the task
+	taskOver bool
+	//owner of the session when created by a Client
+	client *Client
 }
 
 type commonProto struct {
@@ -118,70 +197,177 @@ func newNlsProto(connConfig *ConnectionConfig,
 	} else {
 		nls.logger = logger
 	}
+	nls.logger.setRedactSecret(redactSlot(connConfig, "token"), connConfig.token())
+	nls.logger.setRedactSecret(redactSlot(connConfig, "akkey"), connConfig.Akkey)
 
 	nls.param = param
 	return nls, nil
 }
 
-func (nls *nlsProto) Connect() error {
-	if nls.conn != nil {
-		nls.conn.shutdown()
-		time.Sleep(time.Millisecond * 100)
-	}
-
-	ws, err := newWsConnection(nls.connConfig.Url,
-		nls.connConfig.Token, 10*time.Second, nls.connConfig.Rbuffer,
-		nls.connConfig.Wbuffer, nls.logger,
-		//recv frame
-		func(rawData bool, data []byte) {
-			if rawData {
-				handler, ok := nls.proto.handlers[RAW_HANDLER]
-				if !ok {
-					nls.logger.Fatal("NO RAW_HANDLER BUT recv RAW FRAME")
-					return
-				} else {
-					handler(false, data, nls)
-				}
+// supplier of established connections shared between sessions, frames
+// for the session holding the connection are routed to handleFrame
+type connSource interface {
+	acquire(nls *nlsProto) (*wsConnection, string, error)
+	release(nls *nlsProto, reusable bool)
+}
+
+func (nls *nlsProto) handleFrame(rawData bool, data []byte) {
+	if rec := nls.currentRecorder(); rec != nil {
+		if rawData {
+			rec.record(RECORD_RECV, true, "", data)
+		} else {
+			rec.record(RECORD_RECV, false, string(data), nil)
+		}
+	}
+	if rawData {
+		handler, ok := nls.proto.handlers[RAW_HANDLER]
+		if !ok {
+			nls.logger.Fatal("NO RAW_HANDLER BUT recv RAW FRAME")
+			return
+		} else {
+			handler(false, data, nls)
+		}
+	} else {
+		nls.logger.Debugf("recv raw frame:%s", string(data))
+		resp := CommonResponse{}
+		err := json.Unmarshal(data, &resp)
+		if err != nil {
+			nls.logger.Println("OCCUR UNKNOWN PROTO:", err)
+			return
+		}
+
+		if resp.Header.Name == TASK_FAILED_NAME {
+			nls.checkThrottled(LookupStatus(resp.Header.Status).Class)
+		}
+		if resp.Header.Namespace != "Default" && resp.Header.Namespace != nls.proto.namespace {
+			nls.logger.Fatalf("WTF namespace mismatch expect %s but %s", nls.proto.namespace, resp.Header.Namespace)
+			return
+		}
+		handler, ok := nls.proto.handlers[resp.Header.Name]
+		if !ok {
+			nls.logger.Printf("no handler for %s", resp.Header.Name)
+			if cust_handler, ok := nls.proto.handlers[CUSTOM_DEFINED_NAME]; ok {
+				nls.logger.Println("using custom handler for", resp.Header.Name)
+				cust_handler(false, data, nls)
 			} else {
-				nls.logger.Debugf("recv raw frame:%s", string(data))
-				resp := CommonResponse{}
-				err := json.Unmarshal(data, &resp)
-				if err != nil {
-					nls.logger.Println("OCCUR UNKNOWN PROTO:", err)
-					return
-				}
+				nls.logger.Println("no custom handler for", resp.Header.Name)
+			}
+			return
+		}
+		handler(false, data, nls)
+		nls.lk.Lock()
+		over := nls.taskOver
+		nls.lk.Unlock()
+		if over {
+			nls.endTask(resp.Header.Name != TASK_FAILED_NAME)
+		}
+	}
+}
+
+func (nls *nlsProto) handleClose(text string) {
+	if rec := nls.currentRecorder(); rec != nil {
+		rec.record(RECORD_CLOSE, false, text, nil)
+	}
+	nls.releaseLimit()
+	handler, ok := nls.proto.handlers[CLOSE_HANDLER]
+	if ok {
+		handler(true, []byte(text), nls)
+	}
+	nls.endTask(false)
+}
 
-				if resp.Header.Namespace != "Default" && resp.Header.Namespace != nls.proto.namespace {
-					nls.logger.Fatalf("WTF namespace mismatch expect %s but %s", nls.proto.namespace, resp.Header.Namespace)
+// dial the endpoints of config in health order until one accepts
+func dialEndpoints(config *ConnectionConfig, logger *NlsLogger,
+	recv func(rawData bool, data []byte),
+	closed func(code int, text string, err error)) (*wsConnection, string, error) {
+	dialRetry := 5
+	if config.Retry != nil {
+		dialRetry = 1
+	}
+
+	var lastErr error
+	pool := config.endpointPool()
+	for _, state := range pool.ordered() {
+		token, err := pool.token(config, state)
+		if err != nil {
+			pool.report(state, 0, err)
+			lastErr = err
+			continue
+		}
+		logger.setRedactSecret(redactSlot(state, "token"), token)
+
+		begin := time.Now()
+		ws, err := newWsConnection(state.endpoint.Url, token, 10*time.Second,
+			config.Rbuffer, config.Wbuffer, dialRetry, logger, recv, closed)
+		pool.report(state, time.Since(begin), err)
+		if err == nil {
+			return ws, state.endpoint.Url, nil
+		}
+		logger.Printf("connect %s failed: %s", state.endpoint.Url, err)
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
+
+func (nls *nlsProto) Connect() error {
+	nls.lk.Lock()
+	old := nls.conn
+	nls.conn = nil
+	nls.connSeq++
+	seq := nls.connSeq
+	source := nls.source
+	nls.lk.Unlock()
+	if old != nil {
+		if source != nil {
+			source.release(nls, true)
+		} else {
+			old.shutdown()
+		}
+	}
+
+	var ws *wsConnection
+	var endpoint string
+	var err error
+	if source != nil {
+		ws, endpoint, err = source.acquire(nls)
+	} else {
+		ws, endpoint, err = dialEndpoints(nls.connConfig, nls.logger,
+			func(rawData bool, data []byte) {
+				if !nls.isCurrent(seq) {
+					nls.logger.Debugln("drop frame of stale connection")
 					return
 				}
-				handler, ok := nls.proto.handlers[resp.Header.Name]
-				if !ok {
-					nls.logger.Printf("no handler for %s", resp.Header.Name)
-					if cust_handler, ok := nls.proto.handlers[CUSTOM_DEFINED_NAME]; ok {
-						nls.logger.Println("using custom handler for", resp.Header.Name)
-						cust_handler(false, data, nls)
-					} else {
-						nls.logger.Println("no custom handler for", resp.Header.Name)
-					}
+				nls.handleFrame(rawData, data)
+			},
+			func(code int, text string, err error) {
+				if !nls.isCurrent(seq) {
 					return
 				}
-				handler(false, data, nls)
-			}
-		},
-		//close
-		func(code int, text string, err error) {
-			handler, ok := nls.proto.handlers[CLOSE_HANDLER]
-			if ok {
-				handler(true, []byte(text), nls)
-			}
-		})
+				nls.handleClose(text)
+			})
+	}
 	if err != nil {
 		return err
 	}
 
+	nls.lk.Lock()
+	if nls.connSeq != seq {
+		nls.lk.Unlock()
+		if source != nil {
+			source.release(nls, true)
+		} else {
+			ws.shutdown()
+		}
+		return errors.New("connection superseded by a newer one")
+	}
 	nls.conn = ws
-	nls.logger.Println("connect done")
+	nls.endpoint = endpoint
+	rec := nls.recorder
+	nls.lk.Unlock()
+	nls.logger.Println("connect done:", endpoint)
+	if rec != nil {
+		rec.record(RECORD_CONNECT, false, endpoint, nil)
+	}
 	handler, ok := nls.proto.handlers[CONNECTED_HANDLER]
 	if ok {
 		handler(false, nil, nls)
@@ -192,25 +378,377 @@ func (nls *nlsProto) Connect() error {
 	return nil
 }
 
+func (nls *nlsProto) currentEndpoint() string {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	return nls.endpoint
+}
+
+func (nls *nlsProto) isCurrent(seq uint64) bool {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	return nls.connSeq == seq
+}
+
+// connect for a new task, newTask is called before every attempt so the
+// session can assign a fresh task id. ctx bounds the wait for the rate
+// limiter and the backoff between attempts.
+func (nls *nlsProto) startTask(ctx context.Context, newTask func() string) error {
+	//a task lost without notice is over once the next one starts
+	nls.endTask(false)
+	if nls.client != nil {
+		err := nls.client.taskStarted(nls)
+		if err != nil {
+			return err
+		}
+	}
+
+	nls.lk.Lock()
+	nls.taskEnd = make(chan struct{})
+	nls.taskFinal = false
+	nls.taskOver = false
+	nls.lk.Unlock()
+
+	if limiter := nls.connConfig.Limiter; limiter != nil {
+		//the slot of the previous task first, with MaxConcurrent 1 the
+		//wait would be for ourselves
+		nls.releaseLimit()
+		release, err := limiter.Wait(ctx, nls.proto.namespace)
+		if err != nil {
+			nls.endTask(false)
+			return err
+		}
+		nls.lk.Lock()
+		nls.limitRelease = release
+		nls.lk.Unlock()
+	}
+
+	err := nls.connectTask(ctx, newTask)
+	if err != nil {
+		nls.releaseLimit()
+		nls.endTask(false)
+	}
+	return err
+}
+
+func (nls *nlsProto) connectTask(ctx context.Context, newTask func() string) error {
+	nls.lk.Lock()
+	nls.retrySeq++
+	nls.retrying = false
+	nls.attempt = 0
+	nls.newTask = newTask
+	nls.lk.Unlock()
+
+	for {
+		nls.lk.Lock()
+		nls.attempt++
+		attempt := nls.attempt
+		nls.lk.Unlock()
+
+		nls.setTaskId(newTask())
+		err := nls.Connect()
+		if err == nil {
+			return nil
+		}
+		nls.checkThrottled(errorClass(err))
+
+		if nls.connConfig.Retry == nil {
+			return err
+		}
+		wait, ok := nls.connConfig.Retry.next(nls.connConfig, attempt, err)
+		if !ok {
+			return err
+		}
+		nls.logger.Printf("start attempt %d failed: %s, retry in %s", attempt, err, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w; retry abandoned: %s", err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// tell the rate limiter about quota rejections
+func (nls *nlsProto) checkThrottled(class StatusClass) {
+	if limiter := nls.connConfig.Limiter; limiter != nil && class == STATUS_CLASS_QUOTA {
+		limiter.Throttled(nls.proto.namespace)
+	}
+}
+
+func (nls *nlsProto) releaseLimit() {
+	nls.lk.Lock()
+	release := nls.limitRelease
+	nls.limitRelease = nil
+	nls.lk.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+// called when the server rejects a task before it started, returns true
+// if a new attempt was scheduled in the background, giveUp is called if
+// all later attempts fail to connect
+func (nls *nlsProto) retryStart(err error, giveUp func(error)) bool {
+	if nls.connConfig.Retry == nil {
+		return false
+	}
+
+	nls.lk.Lock()
+	attempt := nls.attempt
+	seq := nls.retrySeq
+	nls.lk.Unlock()
+
+	wait, ok := nls.connConfig.Retry.next(nls.connConfig, attempt, err)
+	if !ok {
+		return false
+	}
+	nls.logger.Printf("task failed on attempt %d: %s, retry in %s", attempt, err, wait)
+	nls.setRetrying(seq, true)
+
+	go func() {
+		for {
+			time.Sleep(wait)
+			nls.lk.Lock()
+			if nls.retrySeq != seq {
+				nls.lk.Unlock()
+				return
+			}
+			nls.attempt++
+			attempt := nls.attempt
+			nls.lk.Unlock()
+
+			nls.setTaskId(nls.newTask())
+			err := nls.Connect()
+			if err == nil {
+				nls.setRetrying(seq, false)
+				return
+			}
+
+			nls.checkThrottled(errorClass(err))
+			wait, ok = nls.connConfig.Retry.next(nls.connConfig, attempt, err)
+			if !ok {
+				nls.setRetrying(seq, false)
+				nls.releaseLimit()
+				giveUp(err)
+				nls.endTask(false)
+				return
+			}
+		}
+	}()
+	return true
+}
+
+func (nls *nlsProto) setRetrying(seq uint64, retrying bool) {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	if nls.retrySeq == seq {
+		nls.retrying = retrying
+	}
+}
+
+// true while a start rejected by the server is being retried
+func (nls *nlsProto) retryPending() bool {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	return nls.retrying
+}
+
+func (nls *nlsProto) setTaskId(taskId string) {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	nls.taskId = taskId
+}
+
+func (nls *nlsProto) currentTaskId() string {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	return nls.taskId
+}
+
+func (nls *nlsProto) setSource(source connSource) {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	nls.source = source
+}
+
+// the task on the current connection is over, a shared connection goes
+// back to its source for the next task
+func (nls *nlsProto) taskDone() {
+	nls.releaseLimit()
+	nls.lk.Lock()
+	nls.taskOver = true
+	source := nls.source
+	conn := nls.conn
+	if source != nil {
+		nls.conn = nil
+	}
+	nls.lk.Unlock()
+
+	if source != nil && conn != nil {
+		source.release(nls, true)
+	}
+}
+
+func (nls *nlsProto) cancelRetry() {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	nls.retrySeq++
+	nls.retrying = false
+}
+
 func (nls *nlsProto) shutdown() error {
-	if nls.conn == nil {
+	nls.releaseLimit()
+	nls.endTask(false)
+	nls.lk.Lock()
+	conn := nls.conn
+	source := nls.source
+	if source != nil {
+		nls.conn = nil
+	}
+	nls.lk.Unlock()
+	if conn == nil {
 		return errors.New("nls proto is nil")
 	}
-	return nls.conn.shutdown()
+
+	//the server may still be running the task, so the shared connection
+	//cannot be handed to anyone else
+	if source != nil {
+		source.release(nls, false)
+		return nil
+	}
+	return conn.shutdown()
+}
+
+func (nls *nlsProto) endTask(final bool) {
+	nls.lk.Lock()
+	if nls.taskEnd == nil {
+		nls.lk.Unlock()
+		return
+	}
+	select {
+	case <-nls.taskEnd:
+		nls.lk.Unlock()
+		return
+	default:
+	}
+	nls.taskFinal = final
+	close(nls.taskEnd)
+	client := nls.client
+	nls.lk.Unlock()
+
+	if client != nil {
+		client.taskEnded(nls, final)
+	}
+}
+
+// wait until the last task started is over, true if it completed
+func (nls *nlsProto) waitTask(ctx context.Context) (bool, error) {
+	nls.lk.Lock()
+	end := nls.taskEnd
+	nls.lk.Unlock()
+	if end == nil {
+		return false, nil
+	}
+
+	select {
+	case <-end:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	return nls.taskFinal, nil
+}
+
+// true while the last task started is not over
+func (nls *nlsProto) taskRunning() bool {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	if nls.taskEnd == nil {
+		return false
+	}
+	select {
+	case <-nls.taskEnd:
+		return false
+	default:
+		return true
+	}
+}
+
+// close a connection of our own with a close handshake of at most
+// timeout, shared connections are left to shutdown
+func (nls *nlsProto) closeGracefully(timeout time.Duration) error {
+	nls.lk.Lock()
+	conn := nls.conn
+	source := nls.source
+	nls.lk.Unlock()
+	if conn == nil || source != nil {
+		return nil
+	}
+	return conn.closeGracefully(timeout)
+}
+
+// true while a connection of our own is up
+func (nls *nlsProto) connOpen() bool {
+	conn := nls.currentConn()
+	return conn != nil && !conn.isClosed()
+}
+
+// fill the keys of startParam left out by the session params with the
+// defaults of the client
+func (nls *nlsProto) applyDefaults(startParam map[string]interface{}) {
+	if nls.client == nil {
+		return
+	}
+	for k, v := range nls.client.defaultsOf(nls.proto.namespace) {
+		if _, ok := startParam[k]; !ok {
+			startParam[k] = v
+		}
+	}
+}
+
+func (nls *nlsProto) currentConn() *wsConnection {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	return nls.conn
 }
 
 func (nls *nlsProto) cmd(cmd string) error {
-	if nls.conn == nil {
+	conn := nls.currentConn()
+	if conn == nil {
 		return errors.New("nls proto is nil")
 	}
 
-	return nls.conn.sendTextData(cmd)
+	err := conn.sendTextData(cmd)
+	if rec := nls.currentRecorder(); rec != nil && err == nil {
+		rec.record(RECORD_SEND, false, cmd, nil)
+	}
+	return err
 }
 
 func (nls *nlsProto) sendRawData(data []byte) error {
-	if nls.conn == nil {
+	conn := nls.currentConn()
+	if conn == nil {
 		return errors.New("nls proto is nil")
 	}
 
-	return nls.conn.sendBinary(data)
+	err := conn.sendBinary(data)
+	if rec := nls.currentRecorder(); rec != nil && err == nil {
+		rec.record(RECORD_SEND, true, "", data)
+	}
+	return err
+}
+
+func (nls *nlsProto) setRecorder(rec *SessionRecorder) {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	nls.recorder = rec
+}
+
+func (nls *nlsProto) currentRecorder() *SessionRecorder {
+	nls.lk.Lock()
+	defer nls.lk.Unlock()
+	return nls.recorder
 }
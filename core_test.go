@@ -0,0 +1,183 @@
+/*
+core_test.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// answers every StartRecognition with RecognitionStarted, with drop the
+// TCP connection is cut right after it without a close frame
+func newRecognizerServer(t *testing.T, drop bool) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt != websocket.TextMessage {
+				continue
+			}
+			req := CommonRequest{}
+			json.Unmarshal(msg, &req)
+			if req.Header.Name != SR_START_NAME {
+				continue
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+				`{"header":{"namespace":"%s","name":"%s","status":20000000,"task_id":"%s"}}`,
+				SR_NAMESPACE, SR_STARTED_NAME, req.Header.TaskId)))
+			if drop {
+				conn.UnderlyingConn().Close()
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newLimitedConfig(srv *httptest.Server) *ConnectionConfig {
+	config := NewConnectionConfigWithToken("ws"+strings.TrimPrefix(srv.URL, "http"), "appkey", "token")
+	config.Limiter = NewRateLimiter(RateLimit{MaxConcurrent: 1})
+	return config
+}
+
+func startWithin(t *testing.T, sr *SpeechRecognition, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ch, err := sr.StartContext(ctx, DefaultSpeechRecognitionParam(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ok := <-ch:
+		if !ok {
+			t.Fatal("start failed:", sr.LastError())
+		}
+	case <-ctx.Done():
+		t.Fatal("start timed out")
+	}
+}
+
+func TestConnectionLostReleasesTask(t *testing.T) {
+	srv := newRecognizerServer(t, true)
+	config := newLimitedConfig(srv)
+	client, err := NewClient(config, NewNlsLogger(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{}, 2)
+	sr, err := client.NewSpeechRecognition(nil, nil, nil, nil,
+		func(param interface{}) { closed <- struct{}{} }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startWithin(t, sr, 2*time.Second)
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("lost connection not reported")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	final, err := sr.nls.waitTask(ctx)
+	if err != nil || final {
+		t.Fatalf("task not ended as failed: final %v, err %v", final, err)
+	}
+	if stats := config.Limiter.Stats(SR_NAMESPACE); stats.Active != 0 {
+		t.Fatalf("limiter slot leaked: %+v", stats)
+	}
+	if stats := client.Stats(); stats.Running != 0 || stats.Failed != 1 {
+		t.Fatalf("task still counted as running: %+v", stats)
+	}
+
+	//the slot is free for the next task
+	startWithin(t, sr, 2*time.Second)
+}
+
+func TestRestartWithConcurrencyLimit(t *testing.T) {
+	srv := newRecognizerServer(t, false)
+	config := newLimitedConfig(srv)
+	sr, err := NewSpeechRecognition(config, NewNlsLogger(ioutil.Discard, "", 0),
+		nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Shutdown()
+
+	startWithin(t, sr, 2*time.Second)
+	//the running task holds the only slot, starting again must give it up
+	//instead of waiting for it
+	startWithin(t, sr, 2*time.Second)
+	if stats := config.Limiter.Stats(SR_NAMESPACE); stats.Active != 1 {
+		t.Fatalf("unexpected limiter slots: %+v", stats)
+	}
+}
+
+func TestConnectionConfigFromJson(t *testing.T) {
+	config, err := NewConnectionConfigFromJson(`{"appkey":"appkey","token":"token","akid":"akid","akkey":"akkey",
+		"token_expire_time":1700000000,
+		"endpoints":[{"url":"wss://nls-gateway.cn-beijing.aliyuncs.com/ws/v1"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Token != "token" || config.Akid != "akid" || config.Akkey != "akkey" || config.TokenExpireTime != 1700000000 {
+		t.Fatalf("credentials not kept: %+v", config)
+	}
+	if config.Url != "wss://nls-gateway.cn-beijing.aliyuncs.com/ws/v1" || len(config.Endpoints) != 1 {
+		t.Fatalf("endpoints not kept: %+v", config)
+	}
+
+	config, err = NewConnectionConfigFromJson(`{"url":"ws://127.0.0.1","appkey":"appkey","token":"token","akid":"akid"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Akid != "" || config.Akkey != "" {
+		t.Fatalf("half an access key kept: %+v", config)
+	}
+
+	_, err = NewConnectionConfigFromJson(`{"url":"ws://127.0.0.1","appkey":"appkey","akid":"akid"}`)
+	if err == nil {
+		t.Fatal("config without token and akkey accepted")
+	}
+	_, err = NewConnectionConfigFromJson(`{"token":"token","appkey":"appkey"}`)
+	if err == nil {
+		t.Fatal("config without url accepted")
+	}
+}
@@ -0,0 +1,254 @@
+/*
+endpoint.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//penalty added to the score for every consecutive dial failure
+	endpointFailurePenalty = 2 * time.Second
+	//failures stop counting against an endpoint after this long
+	endpointFailureDecay = 30 * time.Second
+	//preference given to earlier endpoints in the configured order
+	endpointOrderBias = 50 * time.Millisecond
+	//margin before expiry at which an endpoint token is fetched again
+	endpointTokenMargin = 5 * time.Minute
+)
+
+type Endpoint struct {
+	Url string `json:"url"`
+	//where to obtain a token for this endpoint with akid/akkey, empty
+	//uses the region of a gateway url, else the config token
+	TokenRegion string `json:"token_region,omitempty"`
+	TokenDomain string `json:"token_domain,omitempty"`
+	//fixed token for this endpoint, takes precedence over TokenDomain
+	Token string `json:"token,omitempty"`
+}
+
+func RegionEndpoint(region string) Endpoint {
+	return Endpoint{
+		Url:         fmt.Sprintf("wss://nls-gateway.%s.aliyuncs.com/ws/v1", region),
+		TokenRegion: region,
+		TokenDomain: fmt.Sprintf("nls-meta.%s.aliyuncs.com", region),
+	}
+}
+
+type EndpointStats struct {
+	Url          string
+	Failures     int
+	LastFailure  time.Time
+	Latency      time.Duration
+	Successes    int
+	LastSelected time.Time
+}
+
+type endpointState struct {
+	endpoint Endpoint
+	order    int
+	stats    EndpointStats
+
+	token       string
+	tokenExpire time.Time
+}
+
+func (s *endpointState) score(now time.Time) time.Duration {
+	score := s.stats.Latency + time.Duration(s.order)*endpointOrderBias
+	if s.stats.Failures > 0 && now.Sub(s.stats.LastFailure) < endpointFailureDecay {
+		score += time.Duration(s.stats.Failures) * endpointFailurePenalty
+	}
+	return score
+}
+
+type endpointPool struct {
+	lk     sync.Mutex
+	states []*endpointState
+}
+
+var endpointPoolLk sync.Mutex
+
+// lazily built health state shared by all sessions using the config
+func (config *ConnectionConfig) endpointPool() *endpointPool {
+	endpointPoolLk.Lock()
+	defer endpointPoolLk.Unlock()
+	if config.pool != nil {
+		return config.pool
+	}
+
+	endpoints := config.Endpoints
+	if len(endpoints) == 0 {
+		endpoints = []Endpoint{{Url: config.Url}}
+	}
+
+	pool := new(endpointPool)
+	for i, ep := range endpoints {
+		pool.states = append(pool.states, &endpointState{
+			endpoint: ep,
+			order:    i,
+			stats:    EndpointStats{Url: ep.Url},
+		})
+	}
+	config.pool = pool
+	return pool
+}
+
+func (pool *endpointPool) ordered() []*endpointState {
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	now := time.Now()
+	states := make([]*endpointState, len(pool.states))
+	copy(states, pool.states)
+	sort.SliceStable(states, func(i, j int) bool {
+		return states[i].score(now) < states[j].score(now)
+	})
+	return states
+}
+
+func (pool *endpointPool) report(state *endpointState, latency time.Duration, err error) {
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	now := time.Now()
+	if err != nil {
+		state.stats.Failures++
+		state.stats.LastFailure = now
+		return
+	}
+
+	state.stats.Failures = 0
+	state.stats.Successes++
+	state.stats.LastSelected = now
+	if state.stats.Latency == 0 {
+		state.stats.Latency = latency
+	} else {
+		state.stats.Latency = (state.stats.Latency*7 + latency) / 8
+	}
+}
+
+func (pool *endpointPool) stats() []EndpointStats {
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	stats := make([]EndpointStats, 0, len(pool.states))
+	for _, s := range pool.states {
+		stats = append(stats, s.stats)
+	}
+	return stats
+}
+
+func (pool *endpointPool) resetTokens() {
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	for _, s := range pool.states {
+		s.token = ""
+	}
+}
+
+func (pool *endpointPool) token(config *ConnectionConfig, state *endpointState) (string, error) {
+	if state.endpoint.Token != "" {
+		return state.endpoint.Token, nil
+	}
+	region, domain, ok := state.endpoint.tokenLocation()
+	if !ok || config.Akid == "" || config.Akkey == "" {
+		return config.token(), nil
+	}
+	//the config token is valid wherever it was obtained
+	if _, configDomain := config.TokenLocation(); configDomain == domain {
+		return config.token(), nil
+	}
+
+	pool.lk.Lock()
+	if state.token != "" && time.Until(state.tokenExpire) > endpointTokenMargin {
+		token := state.token
+		pool.lk.Unlock()
+		return token, nil
+	}
+	pool.lk.Unlock()
+
+	tokenMsg, err := GetToken(region, domain, config.Akid, config.Akkey, DEFAULT_VERSION)
+	if err != nil {
+		return "", err
+	}
+	if tokenMsg.TokenResult.Id == "" {
+		return "", fmt.Errorf("obtain empty token from %s err:%s", domain, tokenMsg.ErrMsg)
+	}
+
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	state.token = tokenMsg.TokenResult.Id
+	state.tokenExpire = time.Unix(tokenMsg.TokenResult.ExpireTime, 0)
+	return state.token, nil
+}
+
+// gateway hosts name their region: nls-gateway.cn-beijing.aliyuncs.com,
+// or nls-gateway-cn-beijing(-internal).aliyuncs.com in a vpc
+var gatewayRegionPattern = regexp.MustCompile(`^nls-gateway[.-]([a-z0-9-]+?)(?:-internal)?\.aliyuncs\.com$`)
+
+// region of a gateway url, false for hosts that do not name one
+func gatewayRegion(rawUrl string) (string, bool) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", false
+	}
+	m := gatewayRegionPattern.FindStringSubmatch(u.Hostname())
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// token domain of an endpoint: its TokenDomain, else the one of the
+// region its gateway url names
+func (ep Endpoint) tokenLocation() (region string, domain string, ok bool) {
+	if ep.TokenDomain != "" {
+		region = ep.TokenRegion
+		if region == "" {
+			region = DEFAULT_DISTRIBUTE
+		}
+		return region, ep.TokenDomain, true
+	}
+	if r, ok := gatewayRegion(ep.Url); ok {
+		return r, fmt.Sprintf("nls-meta.%s.aliyuncs.com", r), true
+	}
+	return "", "", false
+}
+
+// TokenLocation tells where the config token is obtained with akid/akkey:
+// the first endpoint with a known token location, else the region of the
+// gateway in Url, else cn-shanghai.
+func (config *ConnectionConfig) TokenLocation() (region string, domain string) {
+	for _, ep := range config.Endpoints {
+		if region, domain, ok := ep.tokenLocation(); ok {
+			return region, domain
+		}
+	}
+
+	if region, domain, ok := (Endpoint{Url: config.Url}).tokenLocation(); ok {
+		return region, domain
+	}
+	return DEFAULT_DISTRIBUTE, DEFAULT_DOMAIN
+}
+
+func (config *ConnectionConfig) EndpointStats() []EndpointStats {
+	return config.endpointPool().stats()
+}
@@ -0,0 +1,66 @@
+/*
+endpoint_test.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import "testing"
+
+func TestTokenLocation(t *testing.T) {
+	cases := []struct {
+		name   string
+		config ConnectionConfig
+		region string
+		domain string
+	}{
+		{"public gateway", ConnectionConfig{Url: "wss://nls-gateway.cn-beijing.aliyuncs.com/ws/v1"},
+			"cn-beijing", "nls-meta.cn-beijing.aliyuncs.com"},
+		{"vpc gateway", ConnectionConfig{Url: "ws://nls-gateway-ap-southeast-1-internal.aliyuncs.com:80/ws/v1"},
+			"ap-southeast-1", "nls-meta.ap-southeast-1.aliyuncs.com"},
+		{"unknown host", ConnectionConfig{Url: "ws://127.0.0.1:8080/ws/v1"},
+			DEFAULT_DISTRIBUTE, DEFAULT_DOMAIN},
+		{"endpoint token domain", ConnectionConfig{
+			Url:       "wss://nls-gateway.cn-beijing.aliyuncs.com/ws/v1",
+			Endpoints: []Endpoint{{Url: "ws://127.0.0.1:8080"}, RegionEndpoint("cn-shenzhen")},
+		}, "cn-shenzhen", "nls-meta.cn-shenzhen.aliyuncs.com"},
+		{"endpoint gateway", ConnectionConfig{
+			Endpoints: []Endpoint{{Url: "wss://nls-gateway.ap-northeast-1.aliyuncs.com/ws/v1"}},
+		}, "ap-northeast-1", "nls-meta.ap-northeast-1.aliyuncs.com"},
+	}
+	for _, c := range cases {
+		region, domain := c.config.TokenLocation()
+		if region != c.region || domain != c.domain {
+			t.Errorf("%s: got %s %s, want %s %s", c.name, region, domain, c.region, c.domain)
+		}
+	}
+}
+
+func TestEndpointTokenFallsBackToConfig(t *testing.T) {
+	config := &ConnectionConfig{
+		Url:   "wss://nls-gateway.cn-beijing.aliyuncs.com/ws/v1",
+		Token: "config-token",
+		Akid:  "akid",
+		Akkey: "akkey",
+	}
+	pool := config.endpointPool()
+	//the only endpoint is where the config token comes from, no second
+	//token is fetched for it
+	token, err := pool.token(config, pool.states[0])
+	if err != nil || token != "config-token" {
+		t.Fatalf("got %q, %v", token, err)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+errors.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type StatusClass int
+
+const (
+	STATUS_CLASS_UNKNOWN StatusClass = iota
+	STATUS_CLASS_AUTH
+	STATUS_CLASS_CLIENT_PARAM
+	STATUS_CLASS_QUOTA
+	STATUS_CLASS_SERVER
+	STATUS_CLASS_TIMEOUT
+)
+
+func (c StatusClass) String() string {
+	switch c {
+	case STATUS_CLASS_AUTH:
+		return "auth"
+	case STATUS_CLASS_CLIENT_PARAM:
+		return "client-param"
+	case STATUS_CLASS_QUOTA:
+		return "quota"
+	case STATUS_CLASS_SERVER:
+		return "server"
+	case STATUS_CLASS_TIMEOUT:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+type StatusInfo struct {
+	Class       StatusClass
+	Description string
+}
+
+// known NLS gateway status codes, anything missing here is classified
+// by its leading digit in LookupStatus
+var StatusCatalog = map[int]StatusInfo{
+	20000000: {STATUS_CLASS_UNKNOWN, "success"},
+
+	40000000: {STATUS_CLASS_CLIENT_PARAM, "default client error"},
+	40000001: {STATUS_CLASS_AUTH, "token invalid or expired"},
+	40000002: {STATUS_CLASS_CLIENT_PARAM, "invalid message"},
+	40000003: {STATUS_CLASS_CLIENT_PARAM, "invalid parameter"},
+	40000004: {STATUS_CLASS_TIMEOUT, "idle timeout"},
+	40000005: {STATUS_CLASS_QUOTA, "too many requests"},
+	//billing failures are permanent, quota only holds throttling
+	40000010: {STATUS_CLASS_CLIENT_PARAM, "free trial expired"},
+	40010001: {STATUS_CLASS_CLIENT_PARAM, "unsupported name"},
+	40010003: {STATUS_CLASS_CLIENT_PARAM, "unsupported directive"},
+	40010004: {STATUS_CLASS_CLIENT_PARAM, "client disconnected"},
+	40010005: {STATUS_CLASS_CLIENT_PARAM, "invalid task state"},
+	40020105: {STATUS_CLASS_AUTH, "appkey not exist"},
+	40020106: {STATUS_CLASS_AUTH, "appkey and token mismatch"},
+	40020503: {STATUS_CLASS_AUTH, "ram sub-account authorization failed"},
+	41010101: {STATUS_CLASS_CLIENT_PARAM, "unsupported sample rate"},
+	41010104: {STATUS_CLASS_CLIENT_PARAM, "audio too long"},
+	41010105: {STATUS_CLASS_CLIENT_PARAM, "pure silence audio"},
+	41040201: {STATUS_CLASS_TIMEOUT, "client read audio timeout"},
+
+	41050001: {STATUS_CLASS_CLIENT_PARAM, "file transcription duration quota exceeded"},
+	41050002: {STATUS_CLASS_CLIENT_PARAM, "file download failed"},
+	41050003: {STATUS_CLASS_CLIENT_PARAM, "file check failed"},
+	41050004: {STATUS_CLASS_CLIENT_PARAM, "file too large"},
+	41050005: {STATUS_CLASS_CLIENT_PARAM, "file normalize failed"},
+	41050006: {STATUS_CLASS_CLIENT_PARAM, "file parse failed"},
+	41050008: {STATUS_CLASS_CLIENT_PARAM, "unsupported sample rate"},
+	41050010: {STATUS_CLASS_CLIENT_PARAM, "file transcription task expired"},
+	41050011: {STATUS_CLASS_CLIENT_PARAM, "invalid file url"},
+	41050012: {STATUS_CLASS_CLIENT_PARAM, "invalid callback url"},
+	41050013: {STATUS_CLASS_CLIENT_PARAM, "invalid request parameter"},
+	41050015: {STATUS_CLASS_AUTH, "appkey not registered"},
+	41050021: {STATUS_CLASS_AUTH, "ram check failed"},
+	41050024: {STATUS_CLASS_CLIENT_PARAM, "file not found"},
+	41050025: {STATUS_CLASS_CLIENT_PARAM, "file access forbidden"},
+	41050026: {STATUS_CLASS_SERVER, "file server error"},
+
+	50000000: {STATUS_CLASS_SERVER, "default server error"},
+	50000001: {STATUS_CLASS_SERVER, "internal call error"},
+	51040101: {STATUS_CLASS_SERVER, "internal server error"},
+	51040103: {STATUS_CLASS_SERVER, "service unavailable"},
+	51040104: {STATUS_CLASS_TIMEOUT, "request server timeout"},
+	51040105: {STATUS_CLASS_SERVER, "call server failed"},
+	51050000: {STATUS_CLASS_SERVER, "file transcription internal error"},
+	52010001: {STATUS_CLASS_SERVER, "internal call error"},
+}
+
+func LookupStatus(status int) StatusInfo {
+	if info, ok := StatusCatalog[status]; ok {
+		return info
+	}
+
+	switch status / 10000000 {
+	case 4:
+		return StatusInfo{STATUS_CLASS_CLIENT_PARAM, "client error"}
+	case 5:
+		return StatusInfo{STATUS_CLASS_SERVER, "server error"}
+	default:
+		return StatusInfo{STATUS_CLASS_UNKNOWN, "unknown status"}
+	}
+}
+
+type TaskError struct {
+	TaskId     string
+	Name       string
+	Status     int
+	StatusText string
+	Class      StatusClass
+	Raw        string
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("task %s failed: status %d(%s): %s", e.TaskId, e.Status, e.Class, e.StatusText)
+}
+
+func (e *TaskError) IsRetryable() bool {
+	switch e.Class {
+	case STATUS_CLASS_QUOTA, STATUS_CLASS_SERVER, STATUS_CLASS_TIMEOUT:
+		return true
+	default:
+		return false
+	}
+}
+
+func ParseTaskError(text string) (*TaskError, error) {
+	resp := CommonResponse{}
+	err := json.Unmarshal([]byte(text), &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TaskError{
+		TaskId:     resp.Header.TaskId,
+		Name:       resp.Header.Name,
+		Status:     resp.Header.Status,
+		StatusText: resp.Header.StatusText,
+		Class:      LookupStatus(resp.Header.Status).Class,
+		Raw:        text,
+	}, nil
+}
+
+func newTaskError(text []byte) error {
+	taskErr, err := ParseTaskError(string(text))
+	if err != nil {
+		return fmt.Errorf("unparsable task failure %q: %w", string(text), err)
+	}
+	return taskErr
+}
+
+func IsRetryable(err error) bool {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.IsRetryable()
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+/*
+events.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_EVENT_BUFFER = 64
+)
+
+type TranscriptionEventType int
+
+const (
+	TRANSCRIPTION_STARTED TranscriptionEventType = iota
+	TRANSCRIPTION_SENTENCE_BEGIN
+	TRANSCRIPTION_SENTENCE_END
+	TRANSCRIPTION_PARTIAL
+	TRANSCRIPTION_COMPLETED
+	TRANSCRIPTION_FAILED
+	TRANSCRIPTION_CLOSED
+)
+
+func (t TranscriptionEventType) String() string {
+	switch t {
+	case TRANSCRIPTION_STARTED:
+		return "started"
+	case TRANSCRIPTION_SENTENCE_BEGIN:
+		return "sentence-begin"
+	case TRANSCRIPTION_SENTENCE_END:
+		return "sentence-end"
+	case TRANSCRIPTION_PARTIAL:
+		return "partial"
+	case TRANSCRIPTION_COMPLETED:
+		return "completed"
+	case TRANSCRIPTION_FAILED:
+		return "failed"
+	case TRANSCRIPTION_CLOSED:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type TranscriptionEvent struct {
+	Type TranscriptionEventType
+	//raw json of the server message, empty for closed
+	Text string
+	//set for failed
+	Err  error
+	Time time.Time
+}
+
+type EventOverflowPolicy int
+
+const (
+	//queued events are dropped from the front to make room, the default
+	EVENT_OVERFLOW_DROP_OLDEST EventOverflowPolicy = iota
+	EVENT_OVERFLOW_DROP_NEWEST
+	//wait for the reader. This stalls the websocket read goroutine while
+	//the buffer is full, and with it every callback of the session, so
+	//only use it with a reader that never stops draining
+	EVENT_OVERFLOW_BLOCK
+)
+
+type eventQueue struct {
+	lk      sync.Mutex
+	ch      chan TranscriptionEvent
+	done    chan struct{}
+	policy  EventOverflowPolicy
+	closed  bool
+	dropped int
+	once    sync.Once
+}
+
+func newEventQueue(buffer int, policy EventOverflowPolicy) *eventQueue {
+	q := new(eventQueue)
+	q.ch = make(chan TranscriptionEvent, buffer)
+	q.done = make(chan struct{})
+	q.policy = policy
+	return q
+}
+
+func (q *eventQueue) push(ev TranscriptionEvent) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if q.closed {
+		return
+	}
+
+	switch q.policy {
+	case EVENT_OVERFLOW_BLOCK:
+		select {
+		case q.ch <- ev:
+		case <-q.done:
+		}
+	case EVENT_OVERFLOW_DROP_NEWEST:
+		select {
+		case q.ch <- ev:
+		default:
+			q.dropped++
+		}
+	default:
+		for {
+			select {
+			case q.ch <- ev:
+				return
+			default:
+			}
+			select {
+			case <-q.ch:
+				q.dropped++
+			default:
+			}
+		}
+	}
+}
+
+func (q *eventQueue) close() {
+	q.once.Do(func() {
+		//a blocked push gives up the lock once done is closed
+		close(q.done)
+		q.lk.Lock()
+		defer q.lk.Unlock()
+		q.closed = true
+		close(q.ch)
+	})
+}
+
+func (q *eventQueue) isClosed() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *eventQueue) droppedCount() int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.dropped
+}
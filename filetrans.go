@@ -0,0 +1,307 @@
+/*
+filetrans.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_FILETRANS_DOMAIN  = "filetrans.cn-shanghai.aliyuncs.com"
+	DEFAULT_FILETRANS_VERSION = "2018-08-17"
+
+	//task version of the service, not the POP api version
+	FILETRANS_TASK_VERSION = "4.0"
+
+	FILETRANS_STATUS_SUCCESS          = 21050000
+	FILETRANS_STATUS_RUNNING          = 21050001
+	FILETRANS_STATUS_QUEUEING         = 21050002
+	FILETRANS_STATUS_SUCCESS_NO_VOICE = 21050003
+
+	DEFAULT_FILETRANS_POLL_INTERVAL     = time.Second
+	DEFAULT_FILETRANS_MAX_POLL_INTERVAL = 10 * time.Second
+)
+
+// FileTranscriptionParam describes one recording file task, nil fields are
+// left to the server default.
+type FileTranscriptionParam struct {
+	FileLink string `json:"file_link"`
+
+	EnableWords                    *bool `json:"enable_words,omitempty"`
+	EnableSampleRateAdaptive       *bool `json:"enable_sample_rate_adaptive,omitempty"`
+	EnableInverseTextNormalization *bool `json:"enable_inverse_text_normalization,omitempty"`
+	EnablePunctuationPrediction    *bool `json:"enable_punctuation_prediction,omitempty"`
+	EnableDisfluency               *bool `json:"enable_disfluency,omitempty"`
+	//speaker separation of mono recordings, sets SpeakerId of the sentences
+	AutoSplit        *bool `json:"auto_split,omitempty"`
+	SpeakerNum       *int  `json:"speaker_num,omitempty"`
+	FirstChannelOnly *bool `json:"first_channel_only,omitempty"`
+
+	VocabularyId    string `json:"vocabulary_id,omitempty"`
+	CustomizationId string `json:"customization_id,omitempty"`
+
+	//the server posts the result there instead of being polled, see
+	//FileTranscriptionCallbackHandler
+	CallbackUrl string `json:"callback_url,omitempty"`
+}
+
+type FileTranscriptionSentence struct {
+	ChannelId       int     `json:"ChannelId"`
+	SpeakerId       string  `json:"SpeakerId,omitempty"`
+	BeginTime       int     `json:"BeginTime"`
+	EndTime         int     `json:"EndTime"`
+	Text            string  `json:"Text"`
+	SilenceDuration int     `json:"SilenceDuration"`
+	SpeechRate      int     `json:"SpeechRate"`
+	EmotionValue    float64 `json:"EmotionValue"`
+}
+
+type FileTranscriptionWord struct {
+	ChannelId int    `json:"ChannelId"`
+	BeginTime int    `json:"BeginTime"`
+	EndTime   int    `json:"EndTime"`
+	Word      string `json:"Word"`
+}
+
+type FileTranscriptionSentences struct {
+	Sentences []FileTranscriptionSentence `json:"Sentences"`
+	Words     []FileTranscriptionWord     `json:"Words,omitempty"`
+}
+
+type FileTranscriptionResult struct {
+	TaskId      string `json:"TaskId"`
+	RequestId   string `json:"RequestId"`
+	StatusCode  int    `json:"StatusCode"`
+	StatusText  string `json:"StatusText"`
+	BizDuration int64  `json:"BizDuration"`
+	SolveTime   int64  `json:"SolveTime"`
+
+	Result FileTranscriptionSentences `json:"Result"`
+}
+
+// still queued or running on the server
+func (r *FileTranscriptionResult) Pending() bool {
+	return r.StatusCode == FILETRANS_STATUS_RUNNING || r.StatusCode == FILETRANS_STATUS_QUEUEING
+}
+
+// nil for a finished task, *TaskError for a failed one
+func (r *FileTranscriptionResult) Err() error {
+	switch r.StatusCode {
+	case FILETRANS_STATUS_SUCCESS, FILETRANS_STATUS_SUCCESS_NO_VOICE,
+		FILETRANS_STATUS_RUNNING, FILETRANS_STATUS_QUEUEING:
+		return nil
+	}
+	return &TaskError{
+		TaskId:     r.TaskId,
+		Name:       "GetTaskResult",
+		Status:     r.StatusCode,
+		StatusText: r.StatusText,
+		Class:      LookupStatus(r.StatusCode).Class,
+	}
+}
+
+type fileTransSubmitResponse struct {
+	TaskId     string `json:"TaskId"`
+	RequestId  string `json:"RequestId"`
+	StatusCode int    `json:"StatusCode"`
+	StatusText string `json:"StatusText"`
+}
+
+// FileTranscription transcribes stored recordings through the
+// SubmitTask/GetTaskResult REST api.
+type FileTranscription struct {
+	PopClient
+
+	//polling starts at PollInterval and doubles up to MaxPollInterval
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+
+	appkey string
+}
+
+func NewFileTranscription(akid string, akkey string, appkey string) (*FileTranscription, error) {
+	if akid == "" || akkey == "" {
+		return nil, errors.New("empty akid or akkey")
+	}
+	if appkey == "" {
+		return nil, errors.New("empty appkey")
+	}
+	pop, err := newPopClient(DEFAULT_DISTRIBUTE, akid, akkey, DEFAULT_FILETRANS_DOMAIN, DEFAULT_FILETRANS_VERSION)
+	if err != nil {
+		return nil, err
+	}
+
+	ft := new(FileTranscription)
+	ft.PopClient = *pop
+	ft.PollInterval = DEFAULT_FILETRANS_POLL_INTERVAL
+	ft.MaxPollInterval = DEFAULT_FILETRANS_MAX_POLL_INTERVAL
+	ft.appkey = appkey
+	return ft, nil
+}
+
+// reuses access key and appkey of a config made by NewConnectionConfigWithAKInfoDefault
+func NewFileTranscriptionWithConfig(config *ConnectionConfig) (*FileTranscription, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	return NewFileTranscription(config.Akid, config.Akkey, config.Appkey)
+}
+
+// Submit creates the task and returns its id.
+func (ft *FileTranscription) Submit(param FileTranscriptionParam) (string, error) {
+	if param.FileLink == "" {
+		return "", errors.New("invalid param: empty file_link")
+	}
+
+	b, err := json.Marshal(param)
+	if err != nil {
+		return "", err
+	}
+	task := make(map[string]interface{})
+	json.Unmarshal(b, &task)
+	task["appkey"] = ft.appkey
+	task["version"] = FILETRANS_TASK_VERSION
+	if param.CallbackUrl != "" {
+		task["enable_callback"] = true
+	}
+	b, err = json.Marshal(task)
+	if err != nil {
+		return "", err
+	}
+
+	request := ft.newRequest("SubmitTask")
+	request.FormParams["Task"] = string(b)
+	resp := new(fileTransSubmitResponse)
+	err = ft.do(request, resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != FILETRANS_STATUS_SUCCESS || resp.TaskId == "" {
+		return "", &TaskError{
+			TaskId:     resp.TaskId,
+			Name:       "SubmitTask",
+			Status:     resp.StatusCode,
+			StatusText: resp.StatusText,
+			Class:      LookupStatus(resp.StatusCode).Class,
+		}
+	}
+	return resp.TaskId, nil
+}
+
+// GetTaskResult queries the task once, check Pending and Err of the result.
+func (ft *FileTranscription) GetTaskResult(taskId string) (*FileTranscriptionResult, error) {
+	if taskId == "" {
+		return nil, errors.New("empty task id")
+	}
+
+	request := ft.newRequest("GetTaskResult")
+	request.Method = "GET"
+	request.QueryParams["TaskId"] = taskId
+	result := new(FileTranscriptionResult)
+	err := ft.do(request, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Wait polls the task with backoff until it finished or ctx is done. Queries
+// failing with network errors, throttling or server errors are retried on
+// the same backoff, other errors are returned at once.
+func (ft *FileTranscription) Wait(ctx context.Context, taskId string) (*FileTranscriptionResult, error) {
+	interval := ft.PollInterval
+	if interval <= 0 {
+		interval = DEFAULT_FILETRANS_POLL_INTERVAL
+	}
+
+	var last *FileTranscriptionResult
+	var lastErr error
+	for {
+		result, err := ft.GetTaskResult(taskId)
+		if err != nil {
+			if !retryablePopError(err) {
+				return last, err
+			}
+			lastErr = err
+		} else {
+			if !result.Pending() {
+				return result, result.Err()
+			}
+			last = result
+			lastErr = nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if lastErr != nil {
+				return last, fmt.Errorf("%w, last query failed: %s", ctx.Err(), lastErr)
+			}
+			return last, ctx.Err()
+		case <-timer.C:
+		}
+
+		interval *= 2
+		if ft.MaxPollInterval > 0 && interval > ft.MaxPollInterval {
+			interval = ft.MaxPollInterval
+		}
+	}
+}
+
+// Transcribe submits the task and waits for its result.
+func (ft *FileTranscription) Transcribe(ctx context.Context, param FileTranscriptionParam) (*FileTranscriptionResult, error) {
+	taskId, err := ft.Submit(param)
+	if err != nil {
+		return nil, err
+	}
+	return ft.Wait(ctx, taskId)
+}
+
+// FileTranscriptionCallbackHandler serves the CallbackUrl of a task, onResult
+// gets the posted result and its Err tells a failed task apart.
+func FileTranscriptionCallbackHandler(onResult func(result *FileTranscriptionResult)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := new(FileTranscriptionResult)
+		err = json.Unmarshal(body, result)
+		if err != nil || result.TaskId == "" {
+			http.Error(w, "invalid callback body", http.StatusBadRequest)
+			return
+		}
+
+		onResult(result)
+		w.WriteHeader(http.StatusOK)
+	})
+}
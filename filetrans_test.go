@@ -0,0 +1,174 @@
+/*
+filetrans_test.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filetrans api stand-in, every GetTaskResult pops the next reply of the
+// task, the last one is repeated
+type fileTransTasks struct {
+	tasks   map[string]interface{}
+	replies []fileTransReply
+}
+
+type fileTransReply struct {
+	httpStatus int
+	body       interface{}
+}
+
+func (f *fileTransTasks) actions() map[string]popAction {
+	return map[string]popAction{
+		"SubmitTask": func(q url.Values) (int, interface{}) {
+			task := make(map[string]interface{})
+			err := json.Unmarshal([]byte(q.Get("Task")), &task)
+			if err != nil {
+				return popError(http.StatusBadRequest, "InvalidParameter")
+			}
+			f.tasks["task-1"] = task
+			return 0, fileTransSubmitResponse{
+				TaskId: "task-1", RequestId: "req", StatusCode: FILETRANS_STATUS_SUCCESS, StatusText: "SUCCESS",
+			}
+		},
+		"GetTaskResult": func(q url.Values) (int, interface{}) {
+			reply := f.replies[0]
+			if len(f.replies) > 1 {
+				f.replies = f.replies[1:]
+			}
+			return reply.httpStatus, reply.body
+		},
+	}
+}
+
+func newTestFileTranscription(t *testing.T, replies ...fileTransReply) (*FileTranscription, *popServer, *fileTransTasks) {
+	ft, err := NewFileTranscription("akid", "akkey", "appkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.PollInterval = time.Millisecond
+	ft.MaxPollInterval = 4 * time.Millisecond
+	f := &fileTransTasks{tasks: make(map[string]interface{}), replies: replies}
+	return ft, newPopServer(t, &ft.PopClient, f.actions()), f
+}
+
+func taskReply(status int, text string) fileTransReply {
+	return fileTransReply{body: FileTranscriptionResult{
+		TaskId: "task-1", RequestId: "req", StatusCode: status, StatusText: text,
+	}}
+}
+
+func serverErrorReply(httpStatus int, code string) fileTransReply {
+	status, body := popError(httpStatus, code)
+	return fileTransReply{httpStatus: status, body: body}
+}
+
+func TestFileTranscriptionSuccess(t *testing.T) {
+	done := taskReply(FILETRANS_STATUS_SUCCESS, "SUCCESS")
+	result := done.body.(FileTranscriptionResult)
+	result.Result.Sentences = []FileTranscriptionSentence{{ChannelId: 0, BeginTime: 100, EndTime: 900, Text: "北京的天气"}}
+	done.body = result
+
+	ft, s, f := newTestFileTranscription(t,
+		taskReply(FILETRANS_STATUS_QUEUEING, "QUEUEING"),
+		serverErrorReply(http.StatusServiceUnavailable, "ServiceUnavailable"),
+		taskReply(FILETRANS_STATUS_RUNNING, "RUNNING"),
+		serverErrorReply(http.StatusTooManyRequests, "Throttling.User"),
+		done,
+	)
+
+	words := true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := ft.Transcribe(ctx, FileTranscriptionParam{
+		FileLink:    "https://example.com/a.wav",
+		EnableWords: &words,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Result.Sentences) != 1 || got.Result.Sentences[0].Text != "北京的天气" {
+		t.Fatalf("unexpected result: %+v", got.Result)
+	}
+	if n := s.callCount("GetTaskResult"); n != 5 {
+		t.Fatalf("expected 5 polls, got %d", n)
+	}
+
+	task := f.tasks["task-1"].(map[string]interface{})
+	if task["appkey"] != "appkey" || task["version"] != FILETRANS_TASK_VERSION ||
+		task["file_link"] != "https://example.com/a.wav" || task["enable_words"] != true {
+		t.Fatalf("unexpected task: %v", task)
+	}
+	if _, ok := task["enable_callback"]; ok {
+		t.Fatalf("callback enabled without callback url: %v", task)
+	}
+}
+
+func TestFileTranscriptionFailedTask(t *testing.T) {
+	ft, _, _ := newTestFileTranscription(t,
+		taskReply(FILETRANS_STATUS_RUNNING, "RUNNING"),
+		taskReply(41050002, "FILE_DOWNLOAD_FAILED"),
+	)
+
+	result, err := ft.Wait(context.Background(), "task-1")
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) {
+		t.Fatalf("expected *TaskError, got %v", err)
+	}
+	if taskErr.Status != 41050002 || taskErr.Class != STATUS_CLASS_CLIENT_PARAM || taskErr.IsRetryable() {
+		t.Fatalf("unexpected task error: %+v", taskErr)
+	}
+	if result == nil || result.StatusText != "FILE_DOWNLOAD_FAILED" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestFileTranscriptionWaitErrors(t *testing.T) {
+	ft, s, _ := newTestFileTranscription(t,
+		taskReply(FILETRANS_STATUS_RUNNING, "RUNNING"),
+		serverErrorReply(http.StatusForbidden, "Forbidden.NoPermission"),
+	)
+	_, err := ft.Wait(context.Background(), "task-1")
+	if err == nil || !strings.Contains(err.Error(), "Forbidden.NoPermission") {
+		t.Fatalf("expected the forbidden error, got %v", err)
+	}
+	if n := s.callCount("GetTaskResult"); n != 2 {
+		t.Fatalf("non retryable error polled %d times", n)
+	}
+
+	ft, s, _ = newTestFileTranscription(t,
+		serverErrorReply(http.StatusInternalServerError, "InternalError"),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = ft.Wait(ctx, "task-1")
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("expected deadline with the last error, got %v", err)
+	}
+	if n := s.callCount("GetTaskResult"); n < 2 {
+		t.Fatalf("server error was not retried, %d polls", n)
+	}
+}
@@ -0,0 +1,592 @@
+/*
+fss.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	//namespace field
+	FSS_NAMESPACE = "FlowingSpeechSynthesizer"
+
+	//name field
+	FSS_START_NAME = "StartSynthesis"
+	FSS_RUN_NAME   = "RunSynthesis"
+	FSS_STOP_NAME  = "StopSynthesis"
+
+	FSS_STARTED_NAME            = "SynthesisStarted"
+	FSS_SENTENCE_BEGIN_NAME     = "SentenceBegin"
+	FSS_SENTENCE_SYNTHESIS_NAME = "SentenceSynthesis"
+	FSS_SENTENCE_END_NAME       = "SentenceEnd"
+	FSS_COMPLETED_NAME          = "SynthesisCompleted"
+
+	//text without punctuation is sent once it grows past this many characters
+	DEFAULT_FSS_FLUSH_THRESHOLD = 100
+
+	fssPunctuation = "，。！？；：、…,.!?;:\n"
+)
+
+type FlowingSpeechSynthesisStartParam struct {
+	Voice      string `json:"voice"`
+	Format     string `json:"format,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	//nil fields are not sent, see Bool and Int
+	Volume         *int  `json:"volume,omitempty"`
+	SpeechRate     *int  `json:"speech_rate,omitempty"`
+	PitchRate      *int  `json:"pitch_rate,omitempty"`
+	EnableSubtitle *bool `json:"enable_subtitle,omitempty"`
+}
+
+func DefaultFlowingSpeechSynthesisParam() FlowingSpeechSynthesisStartParam {
+	return FlowingSpeechSynthesisStartParam{
+		Voice:          "xiaoyun",
+		Format:         "pcm",
+		SampleRate:     16000,
+		Volume:         Int(50),
+		SpeechRate:     Int(0),
+		PitchRate:      Int(0),
+		EnableSubtitle: Bool(false),
+	}
+}
+
+// FlowingSpeechSynthesis synthesizes text that is produced incrementally,
+// e.g. by a language model. Text passed to SendText is buffered and sent
+// up to the last punctuation mark, audio arrives while the session is open.
+type FlowingSpeechSynthesis struct {
+	nls    *nlsProto
+	taskId string
+
+	startCh chan bool
+	stopCh  chan bool
+
+	lk      sync.Mutex
+	lastErr error
+	state   SessionState
+
+	//serializes SendText, Flush and Stop so text keeps its order
+	textLk  sync.Mutex
+	pending strings.Builder
+
+	FlushThreshold int
+
+	onTaskFailed        func(text string, param interface{})
+	onStarted           func(text string, param interface{})
+	onSentenceBegin     func(text string, param interface{})
+	onSentenceSynthesis func(text string, param interface{})
+	onSentenceEnd       func(text string, param interface{})
+	onSynthesisResult   func(data []byte, param interface{})
+	onCompleted         func(text string, param interface{})
+	onClose             func(param interface{})
+
+	StartParam map[string]interface{}
+	UserParam  interface{}
+}
+
+func checkFssNlsProto(proto *nlsProto) *FlowingSpeechSynthesis {
+	if proto == nil {
+		log.Default().Fatal("empty proto check failed")
+		return nil
+	}
+
+	fss, ok := proto.param.(*FlowingSpeechSynthesis)
+	if !ok {
+		log.Default().Fatal("proto param not FlowingSpeechSynthesis instance")
+		return nil
+	}
+
+	return fss
+}
+
+func onFssTaskFailedHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	taskErr := newTaskError(text)
+	fss.lk.Lock()
+	starting := fss.startCh != nil
+	fss.lk.Unlock()
+	if starting && fss.nls.retryStart(taskErr, fss.failStart) {
+		return
+	}
+	fss.nls.taskDone()
+
+	if fss.onTaskFailed != nil {
+		fss.onTaskFailed(string(text), fss.UserParam)
+	}
+
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	fss.lastErr = taskErr
+	fss.setState(SESSION_IDLE)
+
+	if fss.startCh != nil {
+		fss.startCh <- false
+		close(fss.startCh)
+		fss.startCh = nil
+	}
+
+	if fss.stopCh != nil {
+		fss.stopCh <- false
+		close(fss.stopCh)
+		fss.stopCh = nil
+	}
+}
+
+func onFssConnectedHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+
+	req := CommonRequest{}
+	req.Context = DefaultContext
+	req.Header.Appkey = fss.nls.connConfig.Appkey
+	req.Header.MessageId = getUuid()
+	req.Header.Name = FSS_START_NAME
+	req.Header.Namespace = FSS_NAMESPACE
+	req.Header.TaskId = fss.taskId
+	req.Payload = fss.StartParam
+
+	b, _ := json.Marshal(req)
+	fss.nls.logger.Println("send:", string(b))
+	fss.nls.cmd(string(b))
+}
+
+func onFssCloseHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	if fss.onClose != nil {
+		fss.onClose(fss.UserParam)
+	}
+
+	//closes of superseded connections never get here, but a start being
+	//retried on a new connection still owns the state
+	if fss.nls.retryPending() {
+		return
+	}
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	fss.setState(SESSION_CLOSED)
+	if fss.startCh != nil {
+		fss.lastErr = errors.New("connection closed before task started")
+		fss.startCh <- false
+		close(fss.startCh)
+		fss.startCh = nil
+	}
+
+	if fss.stopCh != nil {
+		fss.lastErr = errors.New("connection closed before task completed")
+		fss.stopCh <- false
+		close(fss.stopCh)
+		fss.stopCh = nil
+	}
+}
+
+func onFssStartedHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	if fss.onStarted != nil {
+		fss.onStarted(string(text), fss.UserParam)
+	}
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	if fss.state == SESSION_CONNECTING {
+		fss.setState(SESSION_STARTED)
+	}
+	if fss.startCh != nil {
+		fss.startCh <- true
+		close(fss.startCh)
+		fss.startCh = nil
+	}
+}
+
+func onFssSentenceBeginHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	if fss.onSentenceBegin != nil {
+		fss.onSentenceBegin(string(text), fss.UserParam)
+	}
+}
+
+func onFssSentenceSynthesisHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	if fss.onSentenceSynthesis != nil {
+		fss.onSentenceSynthesis(string(text), fss.UserParam)
+	}
+}
+
+func onFssSentenceEndHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	if fss.onSentenceEnd != nil {
+		fss.onSentenceEnd(string(text), fss.UserParam)
+	}
+}
+
+func onFssRawResultHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	if fss.onSynthesisResult != nil {
+		fss.onSynthesisResult(text, fss.UserParam)
+	}
+}
+
+func onFssCompletedHandler(isErr bool, text []byte, proto *nlsProto) {
+	fss := checkFssNlsProto(proto)
+	fss.nls.taskDone()
+	if fss.onCompleted != nil {
+		fss.onCompleted(string(text), fss.UserParam)
+	}
+
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	fss.setState(SESSION_IDLE)
+	if fss.stopCh != nil {
+		fss.stopCh <- true
+		close(fss.stopCh)
+		fss.stopCh = nil
+	}
+}
+
+var fssProto = commonProto{
+	namespace: FSS_NAMESPACE,
+	handlers: map[string]func(bool, []byte, *nlsProto){
+		CLOSE_HANDLER:               onFssCloseHandler,
+		CONNECTED_HANDLER:           onFssConnectedHandler,
+		RAW_HANDLER:                 onFssRawResultHandler,
+		FSS_STARTED_NAME:            onFssStartedHandler,
+		FSS_SENTENCE_BEGIN_NAME:     onFssSentenceBeginHandler,
+		FSS_SENTENCE_SYNTHESIS_NAME: onFssSentenceSynthesisHandler,
+		FSS_SENTENCE_END_NAME:       onFssSentenceEndHandler,
+		FSS_COMPLETED_NAME:          onFssCompletedHandler,
+		TASK_FAILED_NAME:            onFssTaskFailedHandler,
+	},
+}
+
+func newFlowingSpeechSynthesisProto() *commonProto {
+	return &fssProto
+}
+
+func NewFlowingSpeechSynthesis(config *ConnectionConfig,
+	logger *NlsLogger,
+	taskfailed func(string, interface{}),
+	started func(string, interface{}),
+	sentencebegin func(string, interface{}),
+	sentencesynthesis func(string, interface{}),
+	sentenceend func(string, interface{}),
+	synthesisresult func([]byte, interface{}),
+	completed func(string, interface{}),
+	closed func(interface{}),
+	param interface{}) (*FlowingSpeechSynthesis, error) {
+	fss := new(FlowingSpeechSynthesis)
+	proto := newFlowingSpeechSynthesisProto()
+	if logger == nil {
+		logger = DefaultNlsLog()
+	}
+
+	nls, err := newNlsProto(config, proto, logger, fss)
+	if err != nil {
+		return nil, err
+	}
+
+	fss.nls = nls
+	fss.UserParam = param
+	fss.FlushThreshold = DEFAULT_FSS_FLUSH_THRESHOLD
+	fss.onTaskFailed = taskfailed
+	fss.onStarted = started
+	fss.onSentenceBegin = sentencebegin
+	fss.onSentenceSynthesis = sentencesynthesis
+	fss.onSentenceEnd = sentenceend
+	fss.onSynthesisResult = synthesisresult
+	fss.onCompleted = completed
+	fss.onClose = closed
+	return fss, nil
+}
+
+func (fss *FlowingSpeechSynthesis) Start(param FlowingSpeechSynthesisStartParam, extra map[string]interface{}) (chan bool, error) {
+	return fss.StartContext(context.Background(), param, extra)
+}
+
+// StartContext is Start bounded by ctx while waiting for the rate limiter
+// of the config and between connect attempts.
+func (fss *FlowingSpeechSynthesis) StartContext(ctx context.Context, param FlowingSpeechSynthesisStartParam, extra map[string]interface{}) (chan bool, error) {
+	if fss.nls == nil {
+		return nil, errors.New("empty nls: using NewFlowingSpeechSynthesis to create a valid instance")
+	}
+
+	b, err := json.Marshal(param)
+	if err != nil {
+		return nil, err
+	}
+
+	startParam := make(map[string]interface{})
+	json.Unmarshal(b, &startParam)
+	fss.nls.applyDefaults(startParam)
+	for k, v := range extra {
+		startParam[k] = v
+	}
+
+	fss.lk.Lock()
+	if fss.state != SESSION_IDLE && fss.state != SESSION_CLOSED {
+		state := fss.state
+		fss.lk.Unlock()
+		return nil, &StateError{Op: "Start", State: state}
+	}
+	fss.setState(SESSION_CONNECTING)
+	fss.StartParam = startParam
+	fss.lastErr = nil
+	fss.startCh = make(chan bool, 1)
+	ch := fss.startCh
+	fss.lk.Unlock()
+
+	fss.textLk.Lock()
+	fss.pending.Reset()
+	fss.textLk.Unlock()
+
+	err = fss.nls.startTask(ctx, func() string {
+		fss.taskId = getUuid()
+		return fss.taskId
+	})
+	if err != nil {
+		fss.lk.Lock()
+		fss.lastErr = err
+		if fss.startCh == ch {
+			fss.startCh = nil
+		}
+		fss.setState(SESSION_CLOSED)
+		fss.lk.Unlock()
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// SendText buffers text and sends everything up to the last punctuation
+// mark, or all of it once the buffer exceeds FlushThreshold characters.
+func (fss *FlowingSpeechSynthesis) SendText(text string) error {
+	if fss.nls == nil {
+		return errors.New("empty nls: using NewFlowingSpeechSynthesis to create a valid instance")
+	}
+	if state := fss.State(); state != SESSION_STARTED {
+		return &StateError{Op: "SendText", State: state}
+	}
+
+	fss.textLk.Lock()
+	defer fss.textLk.Unlock()
+	fss.pending.WriteString(text)
+	buffered := fss.pending.String()
+
+	cut := strings.LastIndexAny(buffered, fssPunctuation)
+	if cut >= 0 {
+		_, size := utf8.DecodeRuneInString(buffered[cut:])
+		cut += size
+	} else if fss.FlushThreshold > 0 && utf8.RuneCountInString(buffered) >= fss.FlushThreshold {
+		cut = len(buffered)
+	} else {
+		return nil
+	}
+
+	fss.pending.Reset()
+	fss.pending.WriteString(buffered[cut:])
+	return fss.runSynthesis(buffered[:cut])
+}
+
+// send the buffered text regardless of punctuation
+func (fss *FlowingSpeechSynthesis) Flush() error {
+	if fss.nls == nil {
+		return errors.New("empty nls: using NewFlowingSpeechSynthesis to create a valid instance")
+	}
+	if state := fss.State(); state != SESSION_STARTED {
+		return &StateError{Op: "Flush", State: state}
+	}
+
+	fss.textLk.Lock()
+	defer fss.textLk.Unlock()
+	return fss.flushLocked()
+}
+
+// must be called with fss.textLk held
+func (fss *FlowingSpeechSynthesis) flushLocked() error {
+	if fss.pending.Len() == 0 {
+		return nil
+	}
+	text := fss.pending.String()
+	fss.pending.Reset()
+	return fss.runSynthesis(text)
+}
+
+func (fss *FlowingSpeechSynthesis) runSynthesis(text string) error {
+	req := CommonRequest{}
+	req.Context = DefaultContext
+	req.Header.Appkey = fss.nls.connConfig.Appkey
+	req.Header.MessageId = getUuid()
+	req.Header.Name = FSS_RUN_NAME
+	req.Header.Namespace = FSS_NAMESPACE
+	req.Header.TaskId = fss.taskId
+	req.Payload = map[string]interface{}{"text": text}
+
+	b, _ := json.Marshal(req)
+	fss.nls.logger.Debugln("send:", string(b))
+	return fss.nls.cmd(string(b))
+}
+
+// Stop sends the remaining text and asks the server to finish, the channel
+// reports SynthesisCompleted once all audio was delivered.
+func (fss *FlowingSpeechSynthesis) Stop() (chan bool, error) {
+	if fss.nls == nil {
+		return nil, errors.New("empty nls: using NewFlowingSpeechSynthesis to create a valid instance")
+	}
+
+	fss.textLk.Lock()
+	defer fss.textLk.Unlock()
+
+	fss.lk.Lock()
+	if fss.state != SESSION_STARTED {
+		state := fss.state
+		fss.lk.Unlock()
+		return nil, &StateError{Op: "Stop", State: state}
+	}
+	fss.lk.Unlock()
+
+	err := fss.flushLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	fss.lk.Lock()
+	if fss.state != SESSION_STARTED {
+		state := fss.state
+		fss.lk.Unlock()
+		return nil, &StateError{Op: "Stop", State: state}
+	}
+	fss.setState(SESSION_STOPPING)
+	fss.stopCh = make(chan bool, 1)
+	ch := fss.stopCh
+	fss.lk.Unlock()
+
+	req := CommonRequest{}
+	req.Context = DefaultContext
+	req.Header.Appkey = fss.nls.connConfig.Appkey
+	req.Header.MessageId = getUuid()
+	req.Header.Name = FSS_STOP_NAME
+	req.Header.Namespace = FSS_NAMESPACE
+	req.Header.TaskId = fss.taskId
+
+	b, _ := json.Marshal(req)
+	err = fss.nls.cmd(string(b))
+	if err != nil {
+		fss.lk.Lock()
+		if fss.stopCh == ch {
+			fss.stopCh = nil
+		}
+		fss.lk.Unlock()
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func (fss *FlowingSpeechSynthesis) Shutdown() {
+	if fss.nls == nil {
+		return
+	}
+
+	fss.nls.cancelRetry()
+	fss.nls.shutdown()
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	fss.setState(SESSION_CLOSED)
+	if fss.startCh != nil {
+		fss.startCh <- false
+		close(fss.startCh)
+		fss.startCh = nil
+	}
+
+	if fss.stopCh != nil {
+		fss.stopCh <- false
+		close(fss.stopCh)
+		fss.stopCh = nil
+	}
+}
+
+// ShutdownContext lets the synthesis finish before tearing down: sendStop
+// flushes the remaining text and stops, then SynthesisCompleted is awaited
+// until ctx is done and the connection closed with a close handshake.
+// final reports whether the completion arrived, callbacks must not call it.
+func (fss *FlowingSpeechSynthesis) ShutdownContext(ctx context.Context, sendStop bool) (final bool, err error) {
+	if fss.nls == nil {
+		return false, errors.New("empty nls: using NewFlowingSpeechSynthesis to create a valid instance")
+	}
+
+	if sendStop && fss.State() == SESSION_STARTED {
+		_, err = fss.Stop()
+	}
+	if err == nil {
+		final, err = fss.nls.waitTask(ctx)
+	}
+
+	fss.nls.cancelRetry()
+	fss.nls.closeGracefully(DEFAULT_CLOSE_TIMEOUT)
+	fss.Shutdown()
+	return final, err
+}
+
+func (fss *FlowingSpeechSynthesis) failStart(err error) {
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	fss.lastErr = err
+	fss.setState(SESSION_CLOSED)
+	if fss.startCh != nil {
+		fss.startCh <- false
+		close(fss.startCh)
+		fss.startCh = nil
+	}
+}
+
+func (fss *FlowingSpeechSynthesis) State() SessionState {
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	return fss.state
+}
+
+// must be called with fss.lk held
+func (fss *FlowingSpeechSynthesis) setState(state SessionState) {
+	if fss.state != state {
+		fss.nls.logger.Debugf("flowing synthesis %p state %s -> %s", fss, fss.state, state)
+	}
+	fss.state = state
+}
+
+func (fss *FlowingSpeechSynthesis) LastError() error {
+	fss.lk.Lock()
+	defer fss.lk.Unlock()
+	return fss.lastErr
+}
+
+func (fss *FlowingSpeechSynthesis) Endpoint() string {
+	if fss.nls == nil {
+		return ""
+	}
+	return fss.nls.currentEndpoint()
+}
+
+// archive every frame of the following tasks into rec, nil stops recording
+func (fss *FlowingSpeechSynthesis) SetRecorder(rec *SessionRecorder) {
+	if fss.nls == nil {
+		return
+	}
+	fss.nls.setRecorder(rec)
+}
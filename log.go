@@ -19,6 +19,7 @@ limitations under the License.
 package nls
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -28,6 +29,7 @@ type NlsLogger struct {
 	logger *log.Logger
 	sil    bool
 	debug  bool
+	redact *logRedactor
 }
 
 var defaultLog *NlsLogger
@@ -42,6 +44,7 @@ func stdoutLogger(flag int, tag string) *NlsLogger {
 	logger.logger = log.New(os.Stderr, tag, flag)
 	logger.sil = false
 	logger.debug = false
+	logger.redact = newLogRedactor()
 	return logger
 }
 
@@ -50,6 +53,7 @@ func NewNlsLogger(w io.Writer, tag string, flag int) *NlsLogger {
 	logger.logger = log.New(w, tag, flag)
 	logger.sil = false
 	logger.debug = false
+	logger.redact = newLogRedactor()
 	return logger
 }
 
@@ -61,64 +65,85 @@ func (l *NlsLogger) SetDebug(debug bool) {
 	l.debug = debug
 }
 
+// redaction is enabled by default, tokens and akkey are always masked
+// before anything reaches the writer unless explicitly disabled here
+func (l *NlsLogger) SetRedact(enable bool) {
+	l.redact.setEnable(enable)
+}
+
+// mask the values of extra payload fields, for example "text" for tts
+func (l *NlsLogger) AddRedactFields(fields ...string) {
+	l.redact.addFields(fields...)
+}
+
+// mask these exact values wherever they appear in a log line, only the
+// latest 64 secrets are kept
+func (l *NlsLogger) AddRedactSecrets(secrets ...string) {
+	l.redact.addSecrets(secrets...)
+}
+
+func (l *NlsLogger) setRedactSecret(slot string, secret string) {
+	l.redact.setSecret(slot, secret)
+}
+
 func (l *NlsLogger) SetOutput(w io.Writer) {
 	l.logger.SetOutput(w)
 }
 
 func (l *NlsLogger) Fatal(v ...interface{}) {
-	l.logger.Fatal(v...)
+	l.logger.Fatal(l.redact.redact(fmt.Sprint(v...)))
 }
 
 func (l *NlsLogger) Fatalf(format string, v ...interface{}) {
-	l.logger.Fatalf(format, v...)
+	l.logger.Fatal(l.redact.redact(fmt.Sprintf(format, v...)))
 }
 
 func (l *NlsLogger) Fatalln(v ...interface{}) {
-	l.logger.Fatalln(v...)
+	l.logger.Fatal(l.redact.redact(fmt.Sprintln(v...)))
 }
 
 func (l *NlsLogger) Panic(v ...interface{}) {
-	l.logger.Panic(v...)
+	l.logger.Panic(l.redact.redact(fmt.Sprint(v...)))
 }
 
 func (l *NlsLogger) Panicf(format string, v ...interface{}) {
-	l.logger.Panicf(format, v...)
+	l.logger.Panic(l.redact.redact(fmt.Sprintf(format, v...)))
 }
 
 func (l *NlsLogger) panicln(v ...interface{}) {
-	l.logger.Panicln(v...)
+	l.logger.Panic(l.redact.redact(fmt.Sprintln(v...)))
 }
 
 func (l *NlsLogger) Print(v ...interface{}) {
 	if l.sil {
 		return
 	}
-	l.logger.Print(v...)
+	l.logger.Print(l.redact.redact(fmt.Sprint(v...)))
 }
 
 func (l *NlsLogger) Printf(format string, v ...interface{}) {
 	if l.sil {
 		return
 	}
-	l.logger.Printf(format, v...)
+	l.logger.Print(l.redact.redact(fmt.Sprintf(format, v...)))
 }
 
 func (l *NlsLogger) Println(v ...interface{}) {
 	if l.sil {
 		return
 	}
-	l.logger.Println(v...)
+	l.logger.Print(l.redact.redact(fmt.Sprintln(v...)))
 }
 
 func (l *NlsLogger) Debugln(v ...interface{}) {
 	if l.debug {
-		l.logger.Println(v...)
+		l.logger.Print(l.redact.redact(fmt.Sprintln(v...)))
 	}
 }
 
 func (l *NlsLogger) Debugf(format string, v ...interface{}) {
 	if l.debug {
-		l.logger.Printf(format, v...)
+		l.logger.Print(l.redact.redact(fmt.Sprintf(format, v...)))
 	}
 }
 
@@ -0,0 +1,250 @@
+/*
+mux.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MUX_PING_INTERVAL   = 20 * time.Second
+	DEFAULT_MUX_ACQUIRE_TIMEOUT = 10 * time.Second
+)
+
+var errMuxClosed = errors.New("connection mux closed")
+
+// ConnectionMux keeps one websocket warm and runs the tasks of any number
+// of sessions on it, one task at a time. Responses are routed to the
+// session owning the task by header.task_id, and the connection is dialed
+// again when the server closes it.
+type ConnectionMux struct {
+	PingInterval   time.Duration
+	AcquireTimeout time.Duration
+
+	config *ConnectionConfig
+	logger *NlsLogger
+
+	lk       sync.Mutex
+	cond     *sync.Cond
+	conn     *wsConnection
+	endpoint string
+	//bumped on every dial, frames from an older connection are dropped
+	gen     uint64
+	dialing bool
+	active  *nlsProto
+	closed  bool
+}
+
+func NewConnectionMux(config *ConnectionConfig, logger *NlsLogger) (*ConnectionMux, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	if logger == nil {
+		logger = DefaultNlsLog()
+	}
+
+	mux := new(ConnectionMux)
+	mux.PingInterval = DEFAULT_MUX_PING_INTERVAL
+	mux.AcquireTimeout = DEFAULT_MUX_ACQUIRE_TIMEOUT
+	mux.config = config
+	mux.logger = logger
+	mux.cond = sync.NewCond(&mux.lk)
+	return mux, nil
+}
+
+// dial ahead of the first task so it does not pay for the handshake
+func (mux *ConnectionMux) Warmup() error {
+	return mux.ensureConn()
+}
+
+func (mux *ConnectionMux) Close() error {
+	mux.lk.Lock()
+	defer mux.lk.Unlock()
+	mux.closed = true
+	mux.dropConn()
+	mux.cond.Broadcast()
+	return nil
+}
+
+// must be called without mux.lk, the handshake runs unlocked so that Close,
+// release and the frames of the active task are not held up by it. One
+// dial at a time, later callers wait for it and use its connection.
+func (mux *ConnectionMux) ensureConn() error {
+	mux.lk.Lock()
+	for mux.dialing && !mux.closed {
+		mux.cond.Wait()
+	}
+	if mux.closed {
+		mux.lk.Unlock()
+		return errMuxClosed
+	}
+	if mux.conn != nil && !mux.conn.isClosed() {
+		mux.lk.Unlock()
+		return nil
+	}
+	mux.dialing = true
+	mux.gen++
+	gen := mux.gen
+	mux.lk.Unlock()
+
+	ws, endpoint, err := dialEndpoints(mux.config, mux.logger,
+		func(rawData bool, data []byte) {
+			mux.dispatch(gen, rawData, data)
+		},
+		func(code int, text string, err error) {
+			mux.onClose(gen, text)
+		})
+
+	mux.lk.Lock()
+	defer mux.lk.Unlock()
+	mux.dialing = false
+	mux.cond.Broadcast()
+	if err != nil {
+		return err
+	}
+	//closed, or the connection dropped by the server, while dialing
+	if mux.closed || mux.gen != gen {
+		ws.shutdown()
+		if mux.closed {
+			return errMuxClosed
+		}
+		return errors.New("connection mux: connection closed while dialing")
+	}
+
+	mux.logger.Debugln("connection mux dialed:", endpoint)
+	mux.conn = ws
+	mux.endpoint = endpoint
+	if mux.PingInterval > 0 {
+		ws.setPingInterval(mux.PingInterval)
+	}
+	return nil
+}
+
+// must be called with mux.lk held
+func (mux *ConnectionMux) dropConn() {
+	if mux.conn != nil {
+		mux.conn.shutdown()
+		mux.conn = nil
+	}
+	mux.gen++
+}
+
+func (mux *ConnectionMux) dispatch(gen uint64, rawData bool, data []byte) {
+	mux.lk.Lock()
+	active := mux.active
+	current := mux.gen == gen
+	mux.lk.Unlock()
+	if !current || active == nil {
+		mux.logger.Debugln("connection mux drop frame without owner")
+		return
+	}
+
+	if !rawData {
+		resp := CommonResponse{}
+		err := json.Unmarshal(data, &resp)
+		if err == nil && resp.Header.TaskId != "" && resp.Header.TaskId != active.currentTaskId() {
+			mux.logger.Debugln("connection mux drop frame of task", resp.Header.TaskId)
+			return
+		}
+	}
+	active.handleFrame(rawData, data)
+}
+
+func (mux *ConnectionMux) onClose(gen uint64, text string) {
+	mux.lk.Lock()
+	if mux.gen != gen {
+		mux.lk.Unlock()
+		return
+	}
+	mux.conn = nil
+	mux.gen++
+	active := mux.active
+	mux.lk.Unlock()
+
+	mux.logger.Debugln("connection mux closed by server")
+	if active != nil {
+		active.handleClose(text)
+	}
+}
+
+func (mux *ConnectionMux) acquire(nls *nlsProto) (*wsConnection, string, error) {
+	err := mux.reserve(nls)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = mux.ensureConn()
+
+	mux.lk.Lock()
+	defer mux.lk.Unlock()
+	if err == nil && mux.conn == nil {
+		err = errors.New("connection mux: connection closed before the task started")
+	}
+	if err != nil {
+		if mux.active == nls {
+			mux.active = nil
+			mux.cond.Broadcast()
+		}
+		return nil, "", err
+	}
+	return mux.conn, mux.endpoint, nil
+}
+
+// wait until no other session owns the mux and take it for nls
+func (mux *ConnectionMux) reserve(nls *nlsProto) error {
+	mux.lk.Lock()
+	defer mux.lk.Unlock()
+
+	deadline := time.Now().Add(mux.AcquireTimeout)
+	timer := time.AfterFunc(mux.AcquireTimeout, func() {
+		mux.lk.Lock()
+		defer mux.lk.Unlock()
+		mux.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	for mux.active != nil && mux.active != nls && !mux.closed {
+		if !time.Now().Before(deadline) {
+			return errors.New("connection mux busy: previous task still running")
+		}
+		mux.cond.Wait()
+	}
+	if mux.closed {
+		return errMuxClosed
+	}
+	mux.active = nls
+	return nil
+}
+
+func (mux *ConnectionMux) release(nls *nlsProto, reusable bool) {
+	mux.lk.Lock()
+	defer mux.lk.Unlock()
+	if mux.active != nls {
+		return
+	}
+
+	mux.active = nil
+	if !reusable {
+		mux.dropConn()
+	}
+	mux.cond.Broadcast()
+}
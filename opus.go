@@ -0,0 +1,269 @@
+/*
+opus.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	oggPageHeaderSize = 27
+	oggHeaderTypeBOS  = 0x02
+	oggHeaderTypeEOS  = 0x04
+
+	//opu frames carry their length in a single byte
+	OPU_MAX_PACKET_SIZE = 255
+)
+
+var (
+	oggCapture = []byte("OggS")
+	opusHead   = []byte("OpusHead")
+	opusTags   = []byte("OpusTags")
+)
+
+var oggCrcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCrc(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ oggCrcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// OpusHead of an Ogg/Opus stream, RFC 7845 section 5.1
+type OpusHeader struct {
+	Version       uint8
+	Channels      uint8
+	PreSkip       uint16
+	SampleRate    uint32
+	OutputGain    int16
+	MappingFamily uint8
+}
+
+// OggOpusReader extracts the Opus packets of the first logical stream of
+// an Ogg file, the OpusHead and OpusTags header packets are consumed by
+// NewOggOpusReader.
+type OggOpusReader struct {
+	r      io.Reader
+	serial uint32
+	//serial is taken from the first BOS page
+	bound  bool
+	Header OpusHeader
+
+	//packets of the current page not handed out yet
+	packets [][]byte
+	//packet continued on the next page
+	partial []byte
+	eos     bool
+}
+
+func NewOggOpusReader(r io.Reader) (*OggOpusReader, error) {
+	reader := &OggOpusReader{r: r}
+
+	head, err := reader.nextPacket()
+	if err != nil {
+		return nil, fmt.Errorf("ogg opus: read OpusHead: %w", err)
+	}
+	if len(head) < 19 || !bytes.HasPrefix(head, opusHead) {
+		return nil, errors.New("ogg opus: first packet is not OpusHead")
+	}
+	reader.Header = OpusHeader{
+		Version:       head[8],
+		Channels:      head[9],
+		PreSkip:       binary.LittleEndian.Uint16(head[10:12]),
+		SampleRate:    binary.LittleEndian.Uint32(head[12:16]),
+		OutputGain:    int16(binary.LittleEndian.Uint16(head[16:18])),
+		MappingFamily: head[18],
+	}
+
+	tags, err := reader.nextPacket()
+	if err != nil {
+		return nil, fmt.Errorf("ogg opus: read OpusTags: %w", err)
+	}
+	if !bytes.HasPrefix(tags, opusTags) {
+		return nil, errors.New("ogg opus: second packet is not OpusTags")
+	}
+	return reader, nil
+}
+
+// ReadPacket returns the next Opus packet, io.EOF after the last one.
+func (reader *OggOpusReader) ReadPacket() ([]byte, error) {
+	return reader.nextPacket()
+}
+
+func (reader *OggOpusReader) nextPacket() ([]byte, error) {
+	for len(reader.packets) == 0 {
+		if reader.eos {
+			return nil, io.EOF
+		}
+		err := reader.readPage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	packet := reader.packets[0]
+	reader.packets = reader.packets[1:]
+	return packet, nil
+}
+
+func (reader *OggOpusReader) readPage() error {
+	header := make([]byte, oggPageHeaderSize)
+	_, err := io.ReadFull(reader.r, header)
+	if err == io.EOF {
+		//streams cut without an eos page still end cleanly
+		reader.eos = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], oggCapture) {
+		return errors.New("ogg opus: missing OggS capture pattern")
+	}
+	if header[4] != 0 {
+		return fmt.Errorf("ogg opus: unsupported ogg version %d", header[4])
+	}
+
+	headerType := header[5]
+	serial := binary.LittleEndian.Uint32(header[14:18])
+	crc := binary.LittleEndian.Uint32(header[22:26])
+	segments := make([]byte, header[26])
+	_, err = io.ReadFull(reader.r, segments)
+	if err != nil {
+		return err
+	}
+	size := 0
+	for _, lacing := range segments {
+		size += int(lacing)
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(reader.r, body)
+	if err != nil {
+		return err
+	}
+
+	//the crc is computed with its own field zeroed
+	binary.LittleEndian.PutUint32(header[22:26], 0)
+	sum := oggCrc(0, header)
+	sum = oggCrc(sum, segments)
+	sum = oggCrc(sum, body)
+	if sum != crc {
+		return fmt.Errorf("ogg opus: page crc mismatch, serial %d", serial)
+	}
+
+	if headerType&oggHeaderTypeBOS != 0 && !reader.bound {
+		reader.serial = serial
+		reader.bound = true
+	}
+	//pages of other multiplexed streams
+	if !reader.bound || serial != reader.serial {
+		return nil
+	}
+
+	offset := 0
+	for _, lacing := range segments {
+		reader.partial = append(reader.partial, body[offset:offset+int(lacing)]...)
+		offset += int(lacing)
+		if lacing < 255 {
+			reader.packets = append(reader.packets, reader.partial)
+			reader.partial = nil
+		}
+	}
+	if headerType&oggHeaderTypeEOS != 0 {
+		reader.eos = true
+	}
+	return nil
+}
+
+// EncodeOpuPacket frames one Opus packet for the opu format: a length byte
+// followed by the packet.
+func EncodeOpuPacket(packet []byte) ([]byte, error) {
+	if len(packet) == 0 || len(packet) > OPU_MAX_PACKET_SIZE {
+		return nil, fmt.Errorf("opu: packet of %d bytes, expect 1 to %d", len(packet), OPU_MAX_PACKET_SIZE)
+	}
+	frame := make([]byte, 0, len(packet)+1)
+	frame = append(frame, byte(len(packet)))
+	return append(frame, packet...), nil
+}
+
+// LoadOggOpusInOpuChunk reads an Ogg/Opus file into opu framed chunks of
+// packetsPerChunk packets each, ready for SendAudioData with format OPU.
+// The stream should be mono and encoded at the sample rate of the task.
+func LoadOggOpusInOpuChunk(r io.Reader, packetsPerChunk int) (*ChunkBuffer, *OpusHeader, error) {
+	if packetsPerChunk <= 0 {
+		return nil, nil, errors.New("invalid packets per chunk")
+	}
+	reader, err := NewOggOpusReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reader.Header.Channels != 1 {
+		return nil, nil, fmt.Errorf("ogg opus: %d channels, only mono is supported", reader.Header.Channels)
+	}
+
+	buffer := new(ChunkBuffer)
+	buffer.Data = make([]*Chunk, 0)
+	chunk := new(Chunk)
+	count := 0
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		frame, err := EncodeOpuPacket(packet)
+		if err != nil {
+			return nil, nil, err
+		}
+		chunk.Data = append(chunk.Data, frame...)
+		count++
+		if count == packetsPerChunk {
+			buffer.Data = append(buffer.Data, chunk)
+			chunk = new(Chunk)
+			count = 0
+		}
+	}
+	if count > 0 {
+		buffer.Data = append(buffer.Data, chunk)
+	}
+
+	return buffer, &reader.Header, nil
+}
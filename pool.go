@@ -0,0 +1,307 @@
+/*
+pool.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_POOL_MAX_AGE       = 5 * time.Minute
+	DEFAULT_POOL_PING_INTERVAL = 10 * time.Second
+	DEFAULT_POOL_TOKEN_MARGIN  = 5 * time.Minute
+
+	poolRedialBackoff = time.Second
+)
+
+type pooledConn struct {
+	conn        *wsConnection
+	endpoint    string
+	created     time.Time
+	tokenExpire time.Time
+	owner       *nlsProto
+}
+
+// settings of a ConnectionPool, zero fields take the defaults
+type ConnectionPoolOptions struct {
+	//idle connections kept warm
+	Size         int
+	MaxAge       time.Duration
+	PingInterval time.Duration
+	//connections whose token expires within this margin are discarded
+	TokenMargin time.Duration
+}
+
+// ConnectionPool pre-establishes websocket connections so that a new
+// session skips DNS, TCP, TLS and the websocket handshake. Every pooled
+// connection serves exactly one task and is replaced in the background.
+type ConnectionPool struct {
+	//fixed at construction, the replenisher reads them unlocked
+	size         int
+	maxAge       time.Duration
+	pingInterval time.Duration
+	tokenMargin  time.Duration
+
+	config *ConnectionConfig
+	logger *NlsLogger
+
+	lk     sync.Mutex
+	idle   []*pooledConn
+	inUse  map[*nlsProto]*pooledConn
+	closed bool
+	refill chan struct{}
+	done   chan struct{}
+}
+
+func NewConnectionPool(config *ConnectionConfig, logger *NlsLogger, size int) (*ConnectionPool, error) {
+	return NewConnectionPoolWithOptions(config, logger, ConnectionPoolOptions{Size: size})
+}
+
+func NewConnectionPoolWithOptions(config *ConnectionConfig, logger *NlsLogger, opts ConnectionPoolOptions) (*ConnectionPool, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	if opts.Size <= 0 {
+		return nil, errors.New("invalid pool size")
+	}
+	if opts.MaxAge < 0 || opts.PingInterval < 0 || opts.TokenMargin < 0 {
+		return nil, errors.New("invalid pool options: negative duration")
+	}
+	if logger == nil {
+		logger = DefaultNlsLog()
+	}
+
+	pool := new(ConnectionPool)
+	pool.size = opts.Size
+	pool.maxAge = opts.MaxAge
+	if pool.maxAge == 0 {
+		pool.maxAge = DEFAULT_POOL_MAX_AGE
+	}
+	pool.pingInterval = opts.PingInterval
+	if pool.pingInterval == 0 {
+		pool.pingInterval = DEFAULT_POOL_PING_INTERVAL
+	}
+	pool.tokenMargin = opts.TokenMargin
+	if pool.tokenMargin == 0 {
+		pool.tokenMargin = DEFAULT_POOL_TOKEN_MARGIN
+	}
+	pool.config = config
+	pool.logger = logger
+	pool.inUse = make(map[*nlsProto]*pooledConn)
+	pool.refill = make(chan struct{}, 1)
+	pool.done = make(chan struct{})
+	go pool.replenish()
+	return pool, nil
+}
+
+func (pool *ConnectionPool) Close() error {
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	if pool.closed {
+		return nil
+	}
+	pool.closed = true
+	close(pool.done)
+	for _, pc := range pool.idle {
+		pc.conn.shutdown()
+	}
+	pool.idle = nil
+	return nil
+}
+
+// number of warm connections ready to be handed out
+func (pool *ConnectionPool) Idle() int {
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	return len(pool.idle)
+}
+
+func (pool *ConnectionPool) wakeup() {
+	select {
+	case pool.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (pool *ConnectionPool) replenish() {
+	check := pool.maxAge / 4
+	if check <= 0 || check > 10*time.Second {
+		check = 10 * time.Second
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		pool.prune()
+		for pool.Idle() < pool.size {
+			pc, err := pool.dial()
+			if err != nil {
+				pool.logger.Debugln("connection pool dial failed:", err)
+				select {
+				case <-pool.done:
+					return
+				case <-time.After(poolRedialBackoff):
+				}
+				continue
+			}
+
+			pool.lk.Lock()
+			if pool.closed {
+				pool.lk.Unlock()
+				pc.conn.shutdown()
+				return
+			}
+			pool.idle = append(pool.idle, pc)
+			pool.lk.Unlock()
+		}
+
+		select {
+		case <-pool.done:
+			return
+		case <-pool.refill:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pool *ConnectionPool) stale(pc *pooledConn, now time.Time) bool {
+	if pc.conn.isClosed() {
+		return true
+	}
+	if now.Sub(pc.created) > pool.maxAge {
+		return true
+	}
+	return !pc.tokenExpire.IsZero() && pc.tokenExpire.Sub(now) < pool.tokenMargin
+}
+
+func (pool *ConnectionPool) prune() {
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	now := time.Now()
+	idle := pool.idle[:0]
+	for _, pc := range pool.idle {
+		if pool.stale(pc, now) {
+			pool.logger.Debugln("connection pool discard stale connection to", pc.endpoint)
+			pc.conn.shutdown()
+			continue
+		}
+		idle = append(idle, pc)
+	}
+	pool.idle = idle
+}
+
+func (pool *ConnectionPool) dial() (*pooledConn, error) {
+	//renew a token about to expire first, otherwise every new connection
+	//would be discarded right away
+	expire := pool.config.tokenExpireTime()
+	if !expire.IsZero() && time.Until(expire) < pool.tokenMargin && pool.config.Akid != "" {
+		err := refreshConfigToken(pool.config)
+		if err != nil {
+			return nil, err
+		}
+		expire = pool.config.tokenExpireTime()
+	}
+
+	pc := new(pooledConn)
+	ws, endpoint, err := dialEndpoints(pool.config, pool.logger,
+		func(rawData bool, data []byte) {
+			pool.lk.Lock()
+			owner := pc.owner
+			pool.lk.Unlock()
+			if owner != nil {
+				owner.handleFrame(rawData, data)
+			}
+		},
+		func(code int, text string, err error) {
+			pool.lk.Lock()
+			owner := pc.owner
+			pool.lk.Unlock()
+			if owner != nil {
+				owner.handleClose(text)
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	pc.conn = ws
+	pc.endpoint = endpoint
+	pc.created = time.Now()
+	pc.tokenExpire = expire
+	ws.setPingInterval(pool.pingInterval)
+	return pc, nil
+}
+
+func (pool *ConnectionPool) acquire(nls *nlsProto) (*wsConnection, string, error) {
+	pool.lk.Lock()
+	if pool.closed {
+		pool.lk.Unlock()
+		return nil, "", errors.New("connection pool closed")
+	}
+
+	now := time.Now()
+	var pc *pooledConn
+	for len(pool.idle) > 0 && pc == nil {
+		candidate := pool.idle[0]
+		pool.idle = pool.idle[1:]
+		if pool.stale(candidate, now) {
+			candidate.conn.shutdown()
+			continue
+		}
+		pc = candidate
+	}
+	if pc != nil {
+		pc.owner = nls
+		pool.inUse[nls] = pc
+	}
+	pool.lk.Unlock()
+	pool.wakeup()
+	if pc != nil {
+		return pc.conn, pc.endpoint, nil
+	}
+
+	//pool drained, dial in place instead of waiting for the replenisher
+	pool.logger.Debugln("connection pool empty, dialing directly")
+	pc, err := pool.dial()
+	if err != nil {
+		return nil, "", err
+	}
+	pool.lk.Lock()
+	defer pool.lk.Unlock()
+	pc.owner = nls
+	pool.inUse[nls] = pc
+	return pc.conn, pc.endpoint, nil
+}
+
+func (pool *ConnectionPool) release(nls *nlsProto, reusable bool) {
+	pool.lk.Lock()
+	pc, ok := pool.inUse[nls]
+	if ok {
+		delete(pool.inUse, nls)
+		pc.owner = nil
+	}
+	pool.lk.Unlock()
+
+	if ok {
+		pc.conn.shutdown()
+	}
+	pool.wakeup()
+}
@@ -0,0 +1,102 @@
+/*
+pop.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk"
+	sdkerrors "github.com/aliyun/alibaba-cloud-sdk-go/sdk/errors"
+	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
+)
+
+// PopClient is the POP api endpoint shared by GetToken and the REST
+// clients, VocabClient and FileTranscription embed it.
+type PopClient struct {
+	Domain  string
+	Version string
+	//empty uses the POP SDK default, "http" for a local stand-in
+	Scheme string
+
+	client *sdk.Client
+}
+
+func newPopClient(region string, akid string, akkey string, domain string, version string) (*PopClient, error) {
+	client, err := sdk.NewClientWithAccessKey(region, akid, akkey)
+	if err != nil {
+		return nil, err
+	}
+
+	pop := new(PopClient)
+	pop.Domain = domain
+	pop.Version = version
+	pop.client = client
+	return pop, nil
+}
+
+func (pop *PopClient) newRequest(apiName string) *requests.CommonRequest {
+	request := requests.NewCommonRequest()
+	request.Method = "POST"
+	request.Scheme = pop.Scheme
+	request.Domain = pop.Domain
+	request.ApiName = apiName
+	request.Version = pop.Version
+	return request
+}
+
+func (pop *PopClient) do(request *requests.CommonRequest, result interface{}) error {
+	response, err := pop.client.ProcessCommonRequest(request)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(response.GetHttpContentBytes(), result)
+}
+
+// params are sent as query parameters the way the RPC style APIs expect them
+func (pop *PopClient) call(apiName string, params map[string]string, result interface{}) error {
+	request := pop.newRequest(apiName)
+	for k, v := range params {
+		request.QueryParams[k] = v
+	}
+	return pop.do(request, result)
+}
+
+// a failed query that may succeed when asked again: network errors,
+// throttling and 5xx responses of the POP gateway
+func retryablePopError(err error) bool {
+	if isNetworkError(err) {
+		return true
+	}
+
+	var serverErr *sdkerrors.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.HttpStatus() == http.StatusTooManyRequests ||
+			serverErr.HttpStatus() >= http.StatusInternalServerError ||
+			strings.HasPrefix(serverErr.ErrorCode(), "Throttling")
+	}
+	var clientErr *sdkerrors.ClientError
+	if errors.As(err, &clientErr) {
+		return clientErr.ErrorCode() == sdkerrors.TimeoutErrorCode
+	}
+	return IsRetryable(err)
+}
@@ -0,0 +1,99 @@
+/*
+pop_test.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// answers one Action of a POP api stand-in, a zero status is 200
+type popAction func(q url.Values) (status int, body interface{})
+
+// stand-in for a POP api, actions run one at a time so they can share
+// state without locking
+type popServer struct {
+	lk      sync.Mutex
+	actions map[string]popAction
+	calls   []url.Values
+}
+
+func (s *popServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.calls = append(s.calls, r.Form)
+
+	action, ok := s.actions[r.Form.Get("Action")]
+	if !ok {
+		action = func(q url.Values) (int, interface{}) {
+			return popError(http.StatusNotFound, "InvalidAction")
+		}
+	}
+	status, body := action(r.Form)
+	w.Header().Set("Content-Type", "application/json")
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *popServer) lastCall() url.Values {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.calls[len(s.calls)-1]
+}
+
+// calls of action, all calls for an empty action
+func (s *popServer) callCount(action string) int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	n := 0
+	for _, q := range s.calls {
+		if action == "" || q.Get("Action") == action {
+			n++
+		}
+	}
+	return n
+}
+
+func popError(status int, code string) (int, interface{}) {
+	return status, map[string]string{"RequestId": "req", "Code": code, "Message": code}
+}
+
+// points pop to a stand-in serving actions
+func newPopServer(t *testing.T, pop *PopClient, actions map[string]popAction) *popServer {
+	s := &popServer{actions: actions}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	pop.Scheme = "http"
+	pop.Domain = strings.TrimPrefix(srv.URL, "http://")
+	return s
+}
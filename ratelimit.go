@@ -0,0 +1,270 @@
+/*
+ratelimit.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RATE_DECREASE_FACTOR   = 0.5
+	DEFAULT_RATE_RECOVERY_INTERVAL = 10 * time.Second
+
+	//the limits never adapt below this share of the configured ones
+	rateMinScale = 0.1
+	//share of the configured limits regained per recovery interval
+	rateRecoveryStep = 0.1
+	//throttling seen within this window after a decrease counts once
+	rateThrottleHold = time.Second
+)
+
+// RateLimit of one service, zero fields are unlimited.
+type RateLimit struct {
+	//new sessions per second
+	QPS float64
+	//sessions that may start at once after an idle period, at least 1
+	Burst int
+	//sessions running at the same time
+	MaxConcurrent int
+}
+
+type RateLimitStats struct {
+	Active  int
+	Waiting int
+	//share of the configured limits in effect, below 1 after throttling
+	Scale     float64
+	Throttled int64
+}
+
+type serviceLimiter struct {
+	limit   RateLimit
+	tokens  float64
+	last    time.Time
+	active  int
+	waiting int
+	//closed and replaced whenever a session ends or the limits change
+	changed chan struct{}
+
+	scale       float64
+	adjusted    time.Time
+	throttledAt time.Time
+	throttled   int64
+}
+
+// RateLimiter keeps the sessions of a ConnectionConfig, or of every
+// config sharing it, within the limits of each service. Services are
+// told apart by namespace, e.g. ST_NAMESPACE. Throttling reported by the
+// server scales the limits of the service down, they recover while no
+// throttling is seen.
+type RateLimiter struct {
+	//multiplies the limits on throttling, 0 or 1 turns adaptation off
+	DecreaseFactor   float64
+	RecoveryInterval time.Duration
+
+	lk           sync.Mutex
+	defaultLimit RateLimit
+	limits       map[string]RateLimit
+	services     map[string]*serviceLimiter
+}
+
+// limit applies to every service without its own SetLimit
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	l := new(RateLimiter)
+	l.DecreaseFactor = DEFAULT_RATE_DECREASE_FACTOR
+	l.RecoveryInterval = DEFAULT_RATE_RECOVERY_INTERVAL
+	l.defaultLimit = limit
+	l.limits = make(map[string]RateLimit)
+	l.services = make(map[string]*serviceLimiter)
+	return l
+}
+
+func (l *RateLimiter) SetLimit(service string, limit RateLimit) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.limits[service] = limit
+	if s, ok := l.services[service]; ok {
+		s.limit = limit
+		s.notify()
+	}
+}
+
+func (l *RateLimiter) service(name string) *serviceLimiter {
+	s, ok := l.services[name]
+	if !ok {
+		limit, ok := l.limits[name]
+		if !ok {
+			limit = l.defaultLimit
+		}
+		s = &serviceLimiter{
+			limit:   limit,
+			last:    time.Now(),
+			changed: make(chan struct{}),
+			scale:   1,
+		}
+		s.tokens = float64(s.burst())
+		l.services[name] = s
+	}
+	return s
+}
+
+func (s *serviceLimiter) burst() int {
+	if s.limit.Burst < 1 {
+		return 1
+	}
+	return s.limit.Burst
+}
+
+func (s *serviceLimiter) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// refill tokens and recover the scale up to now
+func (l *RateLimiter) refill(s *serviceLimiter, now time.Time) {
+	if s.scale < 1 && l.RecoveryInterval > 0 {
+		steps := int(now.Sub(s.adjusted) / l.RecoveryInterval)
+		if steps > 0 {
+			s.scale += float64(steps) * rateRecoveryStep
+			if s.scale > 1 {
+				s.scale = 1
+			}
+			s.adjusted = s.adjusted.Add(time.Duration(steps) * l.RecoveryInterval)
+		}
+	}
+
+	if s.limit.QPS > 0 {
+		s.tokens += now.Sub(s.last).Seconds() * s.limit.QPS * s.scale
+		if burst := float64(s.burst()); s.tokens > burst {
+			s.tokens = burst
+		}
+	}
+	s.last = now
+}
+
+func (s *serviceLimiter) maxConcurrent() int {
+	if s.limit.MaxConcurrent <= 0 {
+		return 0
+	}
+	n := int(float64(s.limit.MaxConcurrent) * s.scale)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// Wait takes a start token and a concurrency slot of service. It fails at
+// once if ctx is already done and no slot is free, and otherwise waits as
+// long as ctx allows. release gives the slot back and may be called more
+// than once.
+func (l *RateLimiter) Wait(ctx context.Context, service string) (release func(), err error) {
+	l.lk.Lock()
+	s := l.service(service)
+	for {
+		now := time.Now()
+		l.refill(s, now)
+		max := s.maxConcurrent()
+		slot := max == 0 || s.active < max
+		token := s.limit.QPS <= 0 || s.tokens >= 1
+		if slot && token {
+			if s.limit.QPS > 0 {
+				s.tokens--
+			}
+			s.active++
+			l.lk.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() { l.release(s) })
+			}, nil
+		}
+
+		if ctx.Err() != nil {
+			l.lk.Unlock()
+			return nil, fmt.Errorf("rate limit of %s: %w", service, ctx.Err())
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if slot && !token {
+			wait := time.Duration((1 - s.tokens) / (s.limit.QPS * s.scale) * float64(time.Second))
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		changed := s.changed
+		s.waiting++
+		l.lk.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-timeout:
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		l.lk.Lock()
+		s.waiting--
+	}
+}
+
+func (l *RateLimiter) release(s *serviceLimiter) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	s.active--
+	s.notify()
+}
+
+// Throttled reports a throttling rejection of service, the session layer
+// calls it for quota status codes.
+func (l *RateLimiter) Throttled(service string) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	s := l.service(service)
+	s.throttled++
+
+	now := time.Now()
+	if l.DecreaseFactor <= 0 || l.DecreaseFactor >= 1 || now.Sub(s.throttledAt) < rateThrottleHold {
+		return
+	}
+	l.refill(s, now)
+	s.throttledAt = now
+	s.scale *= l.DecreaseFactor
+	if s.scale < rateMinScale {
+		s.scale = rateMinScale
+	}
+	s.adjusted = now
+	//the burst that got throttled is not repeated
+	s.tokens = 0
+}
+
+func (l *RateLimiter) Stats(service string) RateLimitStats {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	s := l.service(service)
+	l.refill(s, time.Now())
+	return RateLimitStats{
+		Active:    s.active,
+		Waiting:   s.waiting,
+		Scale:     s.scale,
+		Throttled: s.throttled,
+	}
+}
@@ -0,0 +1,196 @@
+/*
+record.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_CONNECT = "connect"
+	RECORD_SEND    = "send"
+	RECORD_RECV    = "recv"
+	RECORD_CLOSE   = "close"
+)
+
+// RecordEntry is one line of a session archive. Binary frames keep their
+// bytes in Data, base64 encoded by encoding/json.
+type RecordEntry struct {
+	//milliseconds since the recorder was created
+	Offset int64  `json:"offset_ms"`
+	Dir    string `json:"dir"`
+	Binary bool   `json:"binary,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// SessionRecorder archives everything a session sends and receives as
+// JSON lines. The archive holds the audio too, keep it as private as the
+// recordings themselves.
+type SessionRecorder struct {
+	lk     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	start  time.Time
+	err    error
+}
+
+func NewSessionRecorder(w io.Writer) *SessionRecorder {
+	rec := new(SessionRecorder)
+	rec.w = bufio.NewWriter(w)
+	rec.start = time.Now()
+	if closer, ok := w.(io.Closer); ok {
+		rec.closer = closer
+	}
+	return rec
+}
+
+func NewFileRecorder(path string) (*SessionRecorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionRecorder(f), nil
+}
+
+func (rec *SessionRecorder) record(dir string, binary bool, text string, data []byte) {
+	rec.lk.Lock()
+	defer rec.lk.Unlock()
+	if rec.err != nil {
+		return
+	}
+
+	entry := RecordEntry{
+		Offset: time.Since(rec.start).Milliseconds(),
+		Dir:    dir,
+		Binary: binary,
+		Text:   text,
+		Data:   data,
+	}
+	b, err := json.Marshal(entry)
+	if err == nil {
+		_, err = rec.w.Write(append(b, '\n'))
+	}
+	//stop on the first failure, a truncated archive is still readable
+	rec.err = err
+}
+
+// first write error, nil while recording works
+func (rec *SessionRecorder) Err() error {
+	rec.lk.Lock()
+	defer rec.lk.Unlock()
+	return rec.err
+}
+
+func (rec *SessionRecorder) Flush() error {
+	rec.lk.Lock()
+	defer rec.lk.Unlock()
+	if rec.err != nil {
+		return rec.err
+	}
+	return rec.w.Flush()
+}
+
+// flushes the archive and closes the underlying writer if it is a Closer
+func (rec *SessionRecorder) Close() error {
+	err := rec.Flush()
+	if rec.closer != nil {
+		cerr := rec.closer.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func ReadRecord(r io.Reader) ([]RecordEntry, error) {
+	var entries []RecordEntry
+	scanner := bufio.NewScanner(r)
+	//binary frames make long lines
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := RecordEntry{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return entries, fmt.Errorf("record line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func sessionProto(session interface{}) (*nlsProto, error) {
+	var nls *nlsProto
+	switch s := session.(type) {
+	case *SpeechRecognition:
+		nls = s.nls
+	case *SpeechTranscription:
+		nls = s.nls
+	case *SpeechSynthesis:
+		nls = s.nls
+	case *FlowingSpeechSynthesis:
+		nls = s.nls
+	default:
+		return nil, fmt.Errorf("unsupported session type %T", session)
+	}
+	if nls == nil {
+		return nil, errors.New("empty nls: session not created by its constructor")
+	}
+	return nls, nil
+}
+
+// Replay feeds the received frames and the close of an archive through the
+// handlers of session, which must be created by its New* function but never
+// started. Callbacks and events fire as they did live, without a network.
+func Replay(r io.Reader, session interface{}) error {
+	nls, err := sessionProto(session)
+	if err != nil {
+		return err
+	}
+	entries, err := ReadRecord(r)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		switch entry.Dir {
+		case RECORD_RECV:
+			if entry.Binary {
+				nls.handleFrame(true, entry.Data)
+			} else {
+				nls.handleFrame(false, []byte(entry.Text))
+			}
+		case RECORD_CLOSE:
+			nls.handleClose(entry.Text)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+record_test.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// answers StartTranscription, one SentenceEnd per audio frame and
+// StopTranscription, then closes the connection
+func newTranscriberServer(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		req := CommonRequest{}
+		json.Unmarshal(msg, &req)
+		reply := func(name string, payload string) {
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+				`{"header":{"namespace":"SpeechTranscriber","name":"%s","status":20000000,"task_id":"%s"},"payload":%s}`,
+				name, req.Header.TaskId, payload)))
+		}
+
+		reply("TranscriptionStarted", `{"session_id":"s1"}`)
+		sentences := 0
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == websocket.TextMessage {
+				break
+			}
+			sentences++
+			reply("SentenceEnd", fmt.Sprintf(`{"index":%d,"result":"sentence %d of %d bytes"}`,
+				sentences, sentences, len(data)))
+		}
+		reply("TranscriptionCompleted", `{}`)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		conn.ReadMessage()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type callbackLog struct {
+	lk    sync.Mutex
+	calls []string
+	done  chan struct{}
+}
+
+func (l *callbackLog) add(call string) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func (l *callbackLog) text(name string) func(string, interface{}) {
+	return func(text string, param interface{}) {
+		resp := CommonResponse{}
+		json.Unmarshal([]byte(text), &resp)
+		l.add(name + " " + fmt.Sprint(resp.Payload["result"]))
+	}
+}
+
+func (l *callbackLog) String() string {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return strings.Join(l.calls, "\n")
+}
+
+func newLoggedTranscription(t *testing.T, config *ConnectionConfig) (*SpeechTranscription, *callbackLog) {
+	l := &callbackLog{done: make(chan struct{})}
+	st, err := NewSpeechTranscription(config, NewNlsLogger(ioutil.Discard, "", 0),
+		l.text("failed"), l.text("started"), l.text("begin"), l.text("end"),
+		l.text("changed"), l.text("completed"),
+		func(param interface{}) {
+			l.add("closed")
+			close(l.done)
+		}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, l
+}
+
+func TestRecordReplay(t *testing.T) {
+	srv := newTranscriberServer(t)
+	config := NewConnectionConfigWithToken("ws"+strings.TrimPrefix(srv.URL, "http"), "appkey", "token")
+	fixture := filepath.Join(t.TempDir(), "session.jsonl")
+
+	rec, err := NewFileRecorder(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, live := newLoggedTranscription(t, config)
+	st.SetRecorder(rec)
+
+	started, err := st.Start(DefaultSpeechTranscriptionParam(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-started {
+		t.Fatal("start failed")
+	}
+	st.SendAudioData(make([]byte, 640))
+	st.SendAudioData(make([]byte, 320))
+	stopped, err := st.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-stopped {
+		t.Fatal("stop failed")
+	}
+	select {
+	case <-live.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadRecord(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := make(map[string]int)
+	audio := 0
+	for _, entry := range entries {
+		dirs[entry.Dir]++
+		if entry.Dir == RECORD_SEND && entry.Binary {
+			audio += len(entry.Data)
+		}
+	}
+	if dirs[RECORD_CONNECT] != 1 || dirs[RECORD_CLOSE] != 1 || dirs[RECORD_RECV] != 4 || audio != 960 {
+		t.Fatalf("unexpected archive %v with %d audio bytes", dirs, audio)
+	}
+
+	f, err = os.Open(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	replayed, replay := newLoggedTranscription(t, config)
+	events := replayed.Events()
+	err = Replay(f, replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-replay.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replayed session not closed")
+	}
+
+	want := "started <nil>\nend sentence 1 of 640 bytes\nend sentence 2 of 320 bytes\ncompleted <nil>\nclosed"
+	if live.String() != want {
+		t.Fatalf("unexpected live callbacks:\n%s", live)
+	}
+	if replay.String() != live.String() {
+		t.Fatalf("replay differs from the live session:\n%s\nwant:\n%s", replay, live)
+	}
+
+	var types []TranscriptionEventType
+	for ev := range events {
+		types = append(types, ev.Type)
+	}
+	if len(types) != 5 || types[1] != TRANSCRIPTION_SENTENCE_END || types[4] != TRANSCRIPTION_CLOSED {
+		t.Fatalf("unexpected replayed events %v", types)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+redact.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	REDACT_MASK = "******"
+
+	//secrets shorter than this are not masked verbatim, they would
+	//match too much unrelated text
+	minRedactSecretLen = 6
+	//the oldest secret is forgotten beyond this many, token fields are
+	//still masked by name
+	maxRedactSecrets = 64
+)
+
+var defaultRedactFields = []string{
+	"token",
+	"akkey",
+	DEFAULT_X_NLS_TOKEN_KEY,
+}
+
+type logRedactor struct {
+	lk     sync.RWMutex
+	enable bool
+	fields map[string]bool
+	//secrets by the slot they belong to, a refreshed token replaces the
+	//old one in its slot
+	secrets map[string]string
+	//slots oldest first
+	slots   []string
+	pattern *regexp.Regexp
+}
+
+func newLogRedactor() *logRedactor {
+	r := new(logRedactor)
+	r.enable = true
+	r.fields = make(map[string]bool)
+	r.secrets = make(map[string]string)
+	r.addFields(defaultRedactFields...)
+	return r
+}
+
+func (r *logRedactor) setEnable(enable bool) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.enable = enable
+}
+
+func (r *logRedactor) addFields(fields ...string) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	for _, f := range fields {
+		if f == "" {
+			continue
+		}
+		r.fields[strings.ToLower(f)] = true
+	}
+	r.compile()
+}
+
+func (r *logRedactor) addSecrets(secrets ...string) {
+	for _, s := range secrets {
+		r.setSecret(s, s)
+	}
+}
+
+// slot names the owner of the secret, e.g. the token of one config
+func (r *logRedactor) setSecret(slot string, secret string) {
+	if len(secret) < minRedactSecretLen {
+		return
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if _, ok := r.secrets[slot]; ok {
+		r.secrets[slot] = secret
+		return
+	}
+	if len(r.slots) >= maxRedactSecrets {
+		delete(r.secrets, r.slots[0])
+		r.slots = r.slots[1:]
+	}
+	r.secrets[slot] = secret
+	r.slots = append(r.slots, slot)
+}
+
+func redactSlot(owner interface{}, name string) string {
+	return fmt.Sprintf("%p/%s", owner, name)
+}
+
+// must be called with r.lk held
+func (r *logRedactor) compile() {
+	names := make([]string, 0, len(r.fields))
+	for f := range r.fields {
+		names = append(names, regexp.QuoteMeta(f))
+	}
+	sort.Strings(names)
+	keys := strings.Join(names, "|")
+
+	//first alternative matches json members: "key": "value"
+	//second alternative matches headers and kv pairs: key:[value] or key=value
+	r.pattern = regexp.MustCompile(`(?i)("(?:` + keys + `)"\s*:\s*")((?:[^"\\]|\\.)*)(")` +
+		`|\b(` + keys + `)(\s*[:=]\s*\[?)([^\s\]",}&]+)`)
+}
+
+func (r *logRedactor) redact(s string) string {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	if !r.enable {
+		return s
+	}
+
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, REDACT_MASK)
+	}
+
+	return r.pattern.ReplaceAllString(s, "${1}${4}${5}"+REDACT_MASK+"${3}")
+}
@@ -0,0 +1,209 @@
+/*
+retry.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+type RetryAttempt struct {
+	//1-based number of the attempt that just failed
+	Attempt   int
+	Err       error
+	Class     StatusClass
+	WillRetry bool
+	Backoff   time.Duration
+}
+
+type RetryPolicy struct {
+	//total attempts including the first one
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	//fraction of the backoff randomized in both directions, 0 to 1
+	Jitter float64
+
+	RetryClasses       []StatusClass
+	RetryNetworkErrors bool
+
+	//called before retrying an auth failure, when nil the token is
+	//refreshed from the akid/akkey kept in the config
+	RefreshToken func(config *ConnectionConfig) error
+	OnAttempt    func(attempt RetryAttempt)
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     3 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		RetryClasses: []StatusClass{
+			STATUS_CLASS_AUTH,
+			STATUS_CLASS_QUOTA,
+			STATUS_CLASS_SERVER,
+			STATUS_CLASS_TIMEOUT,
+		},
+		RetryNetworkErrors: true,
+	}
+}
+
+// returned by the websocket dial, carries the http status of a rejected
+// handshake so that auth and overload rejections can be told apart
+type DialError struct {
+	Url        string
+	StatusCode int
+	Err        error
+}
+
+func (e *DialError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("dial %s failed with http status %d: %s", e.Url, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("dial %s failed: %s", e.Url, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+func errorClass(err error) StatusClass {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.Class
+	}
+
+	var dialErr *DialError
+	if errors.As(err, &dialErr) {
+		switch {
+		case dialErr.StatusCode == http.StatusUnauthorized || dialErr.StatusCode == http.StatusForbidden:
+			return STATUS_CLASS_AUTH
+		case dialErr.StatusCode == http.StatusTooManyRequests:
+			return STATUS_CLASS_QUOTA
+		case dialErr.StatusCode >= 500:
+			return STATUS_CLASS_SERVER
+		}
+	}
+
+	return STATUS_CLASS_UNKNOWN
+}
+
+func isNetworkError(err error) bool {
+	var dialErr *DialError
+	if errors.As(err, &dialErr) && dialErr.StatusCode == 0 {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (p *RetryPolicy) shouldRetry(err error) bool {
+	if p.RetryNetworkErrors && isNetworkError(err) {
+		return true
+	}
+
+	class := errorClass(err)
+	for _, c := range p.RetryClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+			d = float64(p.MaxBackoff)
+			break
+		}
+	}
+
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// decide whether the attempt that failed with err is retried, refreshing
+// the token first for auth failures
+func (p *RetryPolicy) next(config *ConnectionConfig, attempt int, err error) (time.Duration, bool) {
+	info := RetryAttempt{
+		Attempt: attempt,
+		Err:     err,
+		Class:   errorClass(err),
+	}
+
+	if attempt < p.MaxAttempts && p.shouldRetry(err) {
+		info.WillRetry = true
+		if info.Class == STATUS_CLASS_AUTH {
+			refresh := p.RefreshToken
+			if refresh == nil {
+				refresh = refreshConfigToken
+			}
+			if rerr := refresh(config); rerr != nil {
+				info.WillRetry = false
+				info.Err = fmt.Errorf("%w; refresh token failed: %s", err, rerr)
+			}
+		}
+	}
+
+	if info.WillRetry {
+		info.Backoff = p.backoff(attempt)
+	}
+	if p.OnAttempt != nil {
+		p.OnAttempt(info)
+	}
+	return info.Backoff, info.WillRetry
+}
+
+func refreshConfigToken(config *ConnectionConfig) error {
+	if config.Akid == "" || config.Akkey == "" {
+		return errors.New("no akid and akkey to refresh token")
+	}
+
+	region, domain := config.TokenLocation()
+	tokenMsg, err := GetToken(region, domain, config.Akid, config.Akkey, DEFAULT_VERSION)
+	if err != nil {
+		return err
+	}
+	if tokenMsg.TokenResult.Id == "" {
+		return fmt.Errorf("obtain empty token err:%s", tokenMsg.ErrMsg)
+	}
+
+	config.setToken(tokenMsg.TokenResult.Id, tokenMsg.TokenResult.ExpireTime)
+	config.endpointPool().resetTokens()
+	return nil
+}
@@ -0,0 +1,566 @@
+/*
+rtp.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	RTP_PAYLOAD_PCMU = 0
+	RTP_PAYLOAD_PCMA = 8
+
+	//packets held back for reordering, 4 packets of 20ms add 80ms latency
+	DEFAULT_RTP_JITTER_DEPTH  = 4
+	DEFAULT_RTP_INACTIVITY    = 5 * time.Second
+	DEFAULT_RTP_START_TIMEOUT = 10 * time.Second
+	DEFAULT_RTP_STOP_TIMEOUT  = 10 * time.Second
+
+	//packets queued per stream while its session is starting
+	rtpStreamQueue = 256
+	//longer gaps are taken as a restart of the sequence, not as loss
+	rtpMaxGap      = 50
+	rtpMaxDatagram = 1500
+)
+
+type RtpPacket struct {
+	Marker      bool
+	PayloadType uint8
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+	Payload     []byte
+}
+
+// ParseRtpPacket decodes an RTP datagram, CSRCs, header extension and
+// padding are skipped. The payload is a copy of b.
+func ParseRtpPacket(b []byte) (*RtpPacket, error) {
+	if len(b) < 12 {
+		return nil, errors.New("rtp: short packet")
+	}
+	if b[0]>>6 != 2 {
+		return nil, fmt.Errorf("rtp: unsupported version %d", b[0]>>6)
+	}
+
+	p := new(RtpPacket)
+	p.Marker = b[1]&0x80 != 0
+	p.PayloadType = b[1] & 0x7f
+	p.Seq = binary.BigEndian.Uint16(b[2:4])
+	p.Timestamp = binary.BigEndian.Uint32(b[4:8])
+	p.SSRC = binary.BigEndian.Uint32(b[8:12])
+
+	offset := 12 + 4*int(b[0]&0x0f)
+	if b[0]&0x10 != 0 {
+		if len(b) < offset+4 {
+			return nil, errors.New("rtp: short header extension")
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(b[offset+2:offset+4]))
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 {
+		pad := int(b[end-1])
+		if pad == 0 || offset+pad > end {
+			return nil, errors.New("rtp: invalid padding")
+		}
+		end -= pad
+	}
+	if offset > end {
+		return nil, errors.New("rtp: header exceeds packet")
+	}
+
+	p.Payload = append([]byte(nil), b[offset:end]...)
+	return p, nil
+}
+
+var (
+	ulawTable [256]int16
+	alawTable [256]int16
+)
+
+func init() {
+	for i := 0; i < 256; i++ {
+		u := ^byte(i)
+		t := (int16(u&0x0f) << 3) + 0x84
+		t <<= (u & 0x70) >> 4
+		if u&0x80 != 0 {
+			ulawTable[i] = 0x84 - t
+		} else {
+			ulawTable[i] = t - 0x84
+		}
+
+		a := byte(i) ^ 0x55
+		t = int16(a&0x0f) << 4
+		switch seg := (a & 0x70) >> 4; seg {
+		case 0:
+			t += 8
+		case 1:
+			t += 0x108
+		default:
+			t += 0x108
+			t <<= seg - 1
+		}
+		if a&0x80 != 0 {
+			alawTable[i] = t
+		} else {
+			alawTable[i] = -t
+		}
+	}
+}
+
+func decodeG711(table *[256]int16, payload []byte) []byte {
+	pcm := make([]byte, 2*len(payload))
+	for i, b := range payload {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(table[b]))
+	}
+	return pcm
+}
+
+// G.711 mu-law to 16 bit little endian pcm
+func DecodePCMU(payload []byte) []byte {
+	return decodeG711(&ulawTable, payload)
+}
+
+// G.711 A-law to 16 bit little endian pcm
+func DecodePCMA(payload []byte) []byte {
+	return decodeG711(&alawTable, payload)
+}
+
+func seqBefore(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// rtpJitterBuffer hands out packets in sequence order, a missing packet is
+// given up once depth packets wait behind it.
+type rtpJitterBuffer struct {
+	depth   int
+	next    uint16
+	started bool
+	pending map[uint16]*RtpPacket
+}
+
+func newRtpJitterBuffer(depth int) *rtpJitterBuffer {
+	if depth <= 0 {
+		depth = 1
+	}
+	return &rtpJitterBuffer{depth: depth, pending: make(map[uint16]*RtpPacket)}
+}
+
+// false for a late or duplicate packet
+func (jb *rtpJitterBuffer) push(p *RtpPacket) bool {
+	if jb.started && seqBefore(p.Seq, jb.next) {
+		return false
+	}
+	if _, ok := jb.pending[p.Seq]; ok {
+		return false
+	}
+	jb.pending[p.Seq] = p
+	return true
+}
+
+func (jb *rtpJitterBuffer) first() uint16 {
+	var min uint16
+	found := false
+	for seq := range jb.pending {
+		if !found || seqBefore(seq, min) {
+			min = seq
+			found = true
+		}
+	}
+	return min
+}
+
+// pop returns the packets ready in order, lost counts the packets skipped
+// before each of them.
+func (jb *rtpJitterBuffer) pop(flush bool) (ready []*RtpPacket, lost []int) {
+	if !jb.started {
+		if len(jb.pending) == 0 || (!flush && len(jb.pending) < jb.depth) {
+			return nil, nil
+		}
+		jb.next = jb.first()
+		jb.started = true
+	}
+
+	gap := 0
+	for len(jb.pending) > 0 {
+		if p, ok := jb.pending[jb.next]; ok {
+			delete(jb.pending, jb.next)
+			ready = append(ready, p)
+			lost = append(lost, gap)
+			gap = 0
+			jb.next++
+			continue
+		}
+		if !flush && len(jb.pending) < jb.depth {
+			break
+		}
+		seq := jb.first()
+		gap = int(seq - jb.next)
+		jb.next = seq
+	}
+	return ready, lost
+}
+
+type rtpStream struct {
+	ssrc    uint32
+	packets chan *RtpPacket
+	quit    chan struct{}
+	dropped int
+}
+
+// RtpIngest receives G.711 RTP over UDP and transcribes every SSRC with
+// its own SpeechTranscription. Payload types other than PCMU and PCMA,
+// comfort noise and telephone events included, are ignored and the gap
+// they leave is filled with silence like a lost packet.
+type RtpIngest struct {
+	JitterDepth int
+	//a stream without packets for this long is stopped
+	Inactivity time.Duration
+	//bounds the wait for the rate limiter and TranscriptionStarted
+	StartTimeout time.Duration
+	StopTimeout  time.Duration
+	//called when the session of a stream has ended, err is nil after a
+	//clean stop
+	OnStreamEnd func(ssrc uint32, err error)
+
+	conn       net.PacketConn
+	logger     *NlsLogger
+	param      SpeechTranscriptionStartParam
+	extra      map[string]interface{}
+	newSession func(ssrc uint32) (*SpeechTranscription, error)
+
+	lk      sync.Mutex
+	streams map[uint32]*rtpStream
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewRtpIngest reads RTP from conn once Serve is called. newSession returns
+// a session made by NewSpeechTranscription for a new SSRC, with the
+// callbacks of that call, the ingest starts it with param and extra.
+// Format and SampleRate of param are set to pcm and 8000.
+func NewRtpIngest(conn net.PacketConn,
+	logger *NlsLogger,
+	param SpeechTranscriptionStartParam,
+	extra map[string]interface{},
+	newSession func(ssrc uint32) (*SpeechTranscription, error)) (*RtpIngest, error) {
+	if conn == nil {
+		return nil, errors.New("empty conn")
+	}
+	if newSession == nil {
+		return nil, errors.New("empty session factory")
+	}
+	if logger == nil {
+		logger = DefaultNlsLog()
+	}
+
+	param.Format = PCM
+	param.SampleRate = 8000
+	err := param.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	ingest := new(RtpIngest)
+	ingest.JitterDepth = DEFAULT_RTP_JITTER_DEPTH
+	ingest.Inactivity = DEFAULT_RTP_INACTIVITY
+	ingest.StartTimeout = DEFAULT_RTP_START_TIMEOUT
+	ingest.StopTimeout = DEFAULT_RTP_STOP_TIMEOUT
+	ingest.conn = conn
+	ingest.logger = logger
+	ingest.param = param
+	ingest.extra = extra
+	ingest.newSession = newSession
+	ingest.streams = make(map[uint32]*rtpStream)
+	return ingest, nil
+}
+
+// Serve reads packets until Close, it returns nil after Close and the read
+// error otherwise.
+func (ingest *RtpIngest) Serve() error {
+	buf := make([]byte, rtpMaxDatagram)
+	for {
+		n, _, err := ingest.conn.ReadFrom(buf)
+		if err != nil {
+			ingest.lk.Lock()
+			closed := ingest.closed
+			ingest.lk.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		p, err := ParseRtpPacket(buf[:n])
+		if err != nil {
+			ingest.logger.Debugf("drop datagram: %s", err)
+			continue
+		}
+		if p.PayloadType != RTP_PAYLOAD_PCMU && p.PayloadType != RTP_PAYLOAD_PCMA {
+			continue
+		}
+		//padding only packets carry no audio, and empty frames must not
+		//reach SendAudioData
+		if len(p.Payload) == 0 {
+			continue
+		}
+		ingest.dispatch(p)
+	}
+}
+
+func (ingest *RtpIngest) dispatch(p *RtpPacket) {
+	ingest.lk.Lock()
+	defer ingest.lk.Unlock()
+	if ingest.closed {
+		return
+	}
+
+	stream := ingest.streams[p.SSRC]
+	if stream == nil {
+		stream = &rtpStream{
+			ssrc:    p.SSRC,
+			packets: make(chan *RtpPacket, rtpStreamQueue),
+			quit:    make(chan struct{}),
+		}
+		ingest.streams[p.SSRC] = stream
+		ingest.wg.Add(1)
+		go ingest.run(stream)
+	}
+
+	//a slow session must not hold up the other streams
+	select {
+	case stream.packets <- p:
+	default:
+		stream.dropped++
+		if stream.dropped%50 == 1 {
+			ingest.logger.Printf("ssrc %d: queue full, %d packets dropped", p.SSRC, stream.dropped)
+		}
+	}
+}
+
+// Streams returns the SSRCs being transcribed.
+func (ingest *RtpIngest) Streams() []uint32 {
+	ingest.lk.Lock()
+	defer ingest.lk.Unlock()
+	ssrcs := make([]uint32, 0, len(ingest.streams))
+	for ssrc := range ingest.streams {
+		ssrcs = append(ssrcs, ssrc)
+	}
+	return ssrcs
+}
+
+// Close stops reading, stops the session of every stream and waits for
+// them to end.
+func (ingest *RtpIngest) Close() error {
+	ingest.lk.Lock()
+	if ingest.closed {
+		ingest.lk.Unlock()
+		return nil
+	}
+	ingest.closed = true
+	for _, stream := range ingest.streams {
+		close(stream.quit)
+	}
+	ingest.lk.Unlock()
+
+	err := ingest.conn.Close()
+	ingest.wg.Wait()
+	return err
+}
+
+// the stream leaves the map only while its queue is empty, so no packet
+// is lost to a stream that is ending
+func (ingest *RtpIngest) remove(stream *rtpStream) bool {
+	ingest.lk.Lock()
+	defer ingest.lk.Unlock()
+	if len(stream.packets) > 0 {
+		return false
+	}
+	if ingest.streams[stream.ssrc] == stream {
+		delete(ingest.streams, stream.ssrc)
+	}
+	return true
+}
+
+func (ingest *RtpIngest) run(stream *rtpStream) {
+	defer ingest.wg.Done()
+
+	err := ingest.serveStream(stream)
+	if err != nil {
+		ingest.logger.Printf("ssrc %d: %s", stream.ssrc, err)
+	}
+	if ingest.OnStreamEnd != nil {
+		ingest.OnStreamEnd(stream.ssrc, err)
+	}
+}
+
+// drain hands the packets of stream to handle until the stream goes quiet
+// or the ingest is closed
+func (ingest *RtpIngest) drain(stream *rtpStream, handle func(p *RtpPacket)) {
+	inactivity := ingest.Inactivity
+	if inactivity <= 0 {
+		inactivity = DEFAULT_RTP_INACTIVITY
+	}
+	timer := time.NewTimer(inactivity)
+	defer timer.Stop()
+
+	for {
+		select {
+		case p := <-stream.packets:
+			handle(p)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(inactivity)
+		case <-stream.quit:
+			return
+		case <-timer.C:
+			if ingest.remove(stream) {
+				return
+			}
+			timer.Reset(inactivity)
+		}
+	}
+}
+
+func (ingest *RtpIngest) serveStream(stream *rtpStream) error {
+	st, err := ingest.newSession(stream.ssrc)
+	if err == nil && st == nil {
+		err = errors.New("empty session")
+	}
+	if err == nil {
+		err = ingest.startSession(st, stream)
+	}
+	if err != nil {
+		//swallow the stream until it goes quiet, a new session per packet
+		//would only fail again
+		ingest.drain(stream, func(p *RtpPacket) {})
+		return err
+	}
+
+	jb := newRtpJitterBuffer(ingest.JitterDepth)
+	frameSize := 0
+	send := func(flush bool) error {
+		ready, lost := jb.pop(flush)
+		for i, p := range ready {
+			if lost[i] > 0 && lost[i] <= rtpMaxGap && frameSize > 0 {
+				err := st.SendAudioData(make([]byte, 2*frameSize*lost[i]))
+				if err != nil {
+					return err
+				}
+			}
+			var pcm []byte
+			if p.PayloadType == RTP_PAYLOAD_PCMA {
+				pcm = DecodePCMA(p.Payload)
+			} else {
+				pcm = DecodePCMU(p.Payload)
+			}
+			frameSize = len(p.Payload)
+			err := st.SendAudioData(pcm)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var sendErr error
+	ingest.drain(stream, func(p *RtpPacket) {
+		if sendErr == nil {
+			jb.push(p)
+			sendErr = send(false)
+		}
+	})
+	if sendErr == nil {
+		sendErr = send(true)
+	}
+	if sendErr != nil {
+		st.Shutdown()
+		if lastErr := st.LastError(); lastErr != nil {
+			return lastErr
+		}
+		return sendErr
+	}
+	return ingest.stopSession(st)
+}
+
+func (ingest *RtpIngest) startSession(st *SpeechTranscription, stream *rtpStream) error {
+	timeout := ingest.StartTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_RTP_START_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ready, err := st.StartContext(ctx, ingest.param, ingest.extra)
+	if err != nil {
+		return err
+	}
+	select {
+	case ok := <-ready:
+		if !ok {
+			if lastErr := st.LastError(); lastErr != nil {
+				return lastErr
+			}
+			return errors.New("start failed")
+		}
+		return nil
+	case <-ctx.Done():
+		st.Shutdown()
+		return errors.New("timeout waiting for TranscriptionStarted")
+	case <-stream.quit:
+		st.Shutdown()
+		return errors.New("ingest closed while starting")
+	}
+}
+
+func (ingest *RtpIngest) stopSession(st *SpeechTranscription) error {
+	timeout := ingest.StopTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_RTP_STOP_TIMEOUT
+	}
+
+	done, err := st.Stop()
+	if err != nil {
+		st.Shutdown()
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		if !ok {
+			st.Shutdown()
+			if lastErr := st.LastError(); lastErr != nil {
+				return lastErr
+			}
+			return errors.New("stop failed")
+		}
+	case <-timer.C:
+		st.Shutdown()
+		return errors.New("timeout waiting for TranscriptionCompleted")
+	}
+	st.Shutdown()
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+session.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"fmt"
+)
+
+// Lifecycle of a session object:
+//
+//	idle/closed --Start--> connecting --started--> started --Stop--> stopping
+//	stopping --completed--> idle
+//	connecting/started/stopping --failed--> idle
+//	any --connection closed/Shutdown--> closed
+//
+// Start is accepted from idle and closed, so one object can run any number
+// of back-to-back tasks.
+type SessionState int
+
+const (
+	SESSION_IDLE SessionState = iota
+	SESSION_CONNECTING
+	SESSION_STARTED
+	SESSION_STOPPING
+	SESSION_CLOSED
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SESSION_IDLE:
+		return "idle"
+	case SESSION_CONNECTING:
+		return "connecting"
+	case SESSION_STARTED:
+		return "started"
+	case SESSION_STOPPING:
+		return "stopping"
+	case SESSION_CLOSED:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type StateError struct {
+	Op    string
+	State SessionState
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s not allowed in %s state", e.Op, e.State)
+}
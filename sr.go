@@ -16,11 +16,10 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-
-
 package nls
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
@@ -41,20 +40,54 @@ const (
 )
 
 type SpeechRecognitionStartParam struct {
-	Format                         string `json:"format,omitempty"`
-	SampleRate                     int    `json:"sample_rate,omitempty"`
-	EnableIntermediateResult       bool   `json:"enable_intermediate_result"`
-	EnablePunctuationPrediction    bool   `json:"enable_punctuation_prediction"`
-	EnableInverseTextNormalization bool   `json:"enable_inverse_text_normalization"`
+	Format     string `json:"format,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	//nil fields are not sent, see Bool and Int
+	EnableIntermediateResult       *bool `json:"enable_intermediate_result,omitempty"`
+	EnablePunctuationPrediction    *bool `json:"enable_punctuation_prediction,omitempty"`
+	EnableInverseTextNormalization *bool `json:"enable_inverse_text_normalization,omitempty"`
+
+	VocabularyId    string `json:"vocabulary_id,omitempty"`
+	CustomizationId string `json:"customization_id,omitempty"`
+	Disfluency      *bool  `json:"disfluency,omitempty"`
+	//the max silences below are only honoured with voice detection on
+	EnableVoiceDetection *bool `json:"enable_voice_detection,omitempty"`
+	MaxStartSilence      *int  `json:"max_start_silence,omitempty"`
+	MaxEndSilence        *int  `json:"max_end_silence,omitempty"`
+}
+
+// Validate is called by Start before connecting.
+func (p SpeechRecognitionStartParam) Validate() error {
+	err := checkSampleRate(p.SampleRate)
+	if err != nil {
+		return err
+	}
+	detection := p.EnableVoiceDetection != nil && *p.EnableVoiceDetection
+	if !detection && (p.MaxStartSilence != nil || p.MaxEndSilence != nil) {
+		return errors.New("invalid param: max_start_silence and max_end_silence need enable_voice_detection")
+	}
+	if p.MaxStartSilence != nil {
+		err = checkIntRange("max_start_silence", *p.MaxStartSilence, 1, 60000)
+		if err != nil {
+			return err
+		}
+	}
+	if p.MaxEndSilence != nil {
+		err = checkIntRange("max_end_silence", *p.MaxEndSilence, 200, 6000)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func DefaultSpeechRecognitionParam() SpeechRecognitionStartParam {
 	return SpeechRecognitionStartParam{
 		Format:                         "pcm",
 		SampleRate:                     16000,
-		EnableIntermediateResult:       true,
-		EnablePunctuationPrediction:    true,
-		EnableInverseTextNormalization: true,
+		EnableIntermediateResult:       Bool(true),
+		EnablePunctuationPrediction:    Bool(true),
+		EnableInverseTextNormalization: Bool(true),
 	}
 }
 
@@ -65,6 +98,7 @@ type SpeechRecognition struct {
 	startCh chan bool
 	stopCh  chan bool
 	lk      sync.Mutex
+	lastErr error
 
 	onTaskFailed    func(text string, param interface{})
 	onStarted       func(text string, param interface{})
@@ -93,12 +127,22 @@ func checkSrNlsProto(proto *nlsProto) *SpeechRecognition {
 
 func onSrTaskFailedHandler(isErr bool, text []byte, proto *nlsProto) {
 	sr := checkSrNlsProto(proto)
+	taskErr := newTaskError(text)
+	sr.lk.Lock()
+	starting := sr.startCh != nil
+	sr.lk.Unlock()
+	if starting && sr.nls.retryStart(taskErr, sr.failStart) {
+		return
+	}
+	sr.nls.taskDone()
+
 	if sr.onTaskFailed != nil {
 		sr.onTaskFailed(string(text), sr.UserParam)
 	}
 
 	sr.lk.Lock()
 	defer sr.lk.Unlock()
+	sr.lastErr = taskErr
 	if sr.startCh != nil {
 		sr.startCh <- false
 		close(sr.startCh)
@@ -162,6 +206,7 @@ func onSrResultChangedHandler(isErr bool, text []byte, proto *nlsProto) {
 
 func onSrCompletedHandler(isErr bool, text []byte, proto *nlsProto) {
 	sr := checkSrNlsProto(proto)
+	sr.nls.taskDone()
 	if sr.onCompleted != nil {
 		sr.onCompleted(string(text), sr.UserParam)
 	}
@@ -221,35 +266,54 @@ func NewSpeechRecognition(config *ConnectionConfig,
 }
 
 func (sr *SpeechRecognition) Start(param SpeechRecognitionStartParam, extra map[string]interface{}) (chan bool, error) {
+	return sr.StartContext(context.Background(), param, extra)
+}
+
+// StartContext is Start bounded by ctx while waiting for the rate limiter
+// of the config and between connect attempts.
+func (sr *SpeechRecognition) StartContext(ctx context.Context, param SpeechRecognitionStartParam, extra map[string]interface{}) (chan bool, error) {
 	if sr.nls == nil {
 		return nil, errors.New("empty nls: using NewSpeechRecognition to create a valid instance")
 	}
 
+	err := param.Validate()
+	if err != nil {
+		return nil, err
+	}
+
 	b, err := json.Marshal(param)
 	if err != nil {
 		return nil, err
 	}
 
-	json.Unmarshal(b, &sr.StartParam)
-	if extra != nil {
-		if sr.StartParam == nil {
-			sr.StartParam = extra
-		} else {
-			for k, v := range extra {
-				sr.StartParam[k] = v
-			}
-		}
+	startParam := make(map[string]interface{})
+	json.Unmarshal(b, &startParam)
+	sr.nls.applyDefaults(startParam)
+	for k, v := range extra {
+		startParam[k] = v
 	}
-	sr.taskId = getUuid()
-	err = sr.nls.Connect()
+	sr.StartParam = startParam
+	sr.lk.Lock()
+	sr.lastErr = nil
+	sr.startCh = make(chan bool, 1)
+	ch := sr.startCh
+	sr.lk.Unlock()
+
+	err = sr.nls.startTask(ctx, func() string {
+		sr.taskId = getUuid()
+		return sr.taskId
+	})
 	if err != nil {
+		sr.lk.Lock()
+		sr.lastErr = err
+		if sr.startCh == ch {
+			sr.startCh = nil
+		}
+		sr.lk.Unlock()
 		return nil, err
 	}
 
-  sr.lk.Lock()
-  defer sr.lk.Unlock()
-	sr.startCh = make(chan bool, 1)
-	return sr.startCh, nil
+	return ch, nil
 }
 
 func (sr *SpeechRecognition) Stop() (chan bool, error) {
@@ -257,7 +321,6 @@ func (sr *SpeechRecognition) Stop() (chan bool, error) {
 		return nil, errors.New("empty nls: using NewSpeechRecognition to create a valid instance")
 	}
 
-
 	req := CommonRequest{}
 	req.Context = DefaultContext
 	req.Header.Appkey = sr.nls.connConfig.Appkey
@@ -272,8 +335,8 @@ func (sr *SpeechRecognition) Stop() (chan bool, error) {
 		return nil, err
 	}
 
-  sr.lk.Lock()
-  defer sr.lk.Unlock()
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
 	sr.stopCh = make(chan bool, 1)
 	return sr.stopCh, nil
 }
@@ -283,6 +346,7 @@ func (sr *SpeechRecognition) Shutdown() {
 		return
 	}
 
+	sr.nls.cancelRetry()
 	sr.nls.shutdown()
 
 	sr.lk.Lock()
@@ -300,6 +364,35 @@ func (sr *SpeechRecognition) Shutdown() {
 	}
 }
 
+// ShutdownContext stops the recognition if sendStop, waits up to ctx for
+// RecognitionCompleted and closes with a close handshake, final reports
+// whether it arrived. Not for use inside the callbacks.
+func (sr *SpeechRecognition) ShutdownContext(ctx context.Context, sendStop bool) (final bool, err error) {
+	if sr.nls == nil {
+		return false, errors.New("empty nls: using NewSpeechRecognition to create a valid instance")
+	}
+
+	if sendStop && sr.started() {
+		_, err = sr.Stop()
+	}
+	if err == nil {
+		final, err = sr.nls.waitTask(ctx)
+	}
+
+	sr.nls.cancelRetry()
+	sr.nls.closeGracefully(DEFAULT_CLOSE_TIMEOUT)
+	sr.Shutdown()
+	return final, err
+}
+
+// started and neither failed nor stopping
+func (sr *SpeechRecognition) started() bool {
+	sr.lk.Lock()
+	idle := sr.startCh == nil && sr.stopCh == nil
+	sr.lk.Unlock()
+	return idle && sr.nls.taskRunning()
+}
+
 func (sr *SpeechRecognition) SendAudioData(data []byte) error {
 	if sr.nls == nil {
 		return errors.New("empty nls: using NewSpeechRecognition to create a valid instance")
@@ -307,3 +400,53 @@ func (sr *SpeechRecognition) SendAudioData(data []byte) error {
 
 	return sr.nls.sendRawData(data)
 }
+
+// a start retried in the background could not connect again
+func (sr *SpeechRecognition) failStart(err error) {
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+	sr.lastErr = err
+	if sr.startCh != nil {
+		sr.startCh <- false
+		close(sr.startCh)
+		sr.startCh = nil
+	}
+}
+
+// the error behind the last false on the start/stop channels, a *TaskError
+// when the server sent TaskFailed
+func (sr *SpeechRecognition) LastError() error {
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+	return sr.lastErr
+}
+
+// url of the endpoint that served the current or last session
+func (sr *SpeechRecognition) Endpoint() string {
+	if sr.nls == nil {
+		return ""
+	}
+	return sr.nls.currentEndpoint()
+}
+
+// run the tasks of this session on the shared connection of mux instead
+// of dialing one per task, nil goes back to dialing
+func (sr *SpeechRecognition) SetConnectionMux(mux *ConnectionMux) error {
+	if sr.nls == nil {
+		return errors.New("empty nls: using NewSpeechRecognition to create a valid instance")
+	}
+	if mux == nil {
+		sr.nls.setSource(nil)
+		return nil
+	}
+	sr.nls.setSource(mux)
+	return nil
+}
+
+// archive every frame of the following tasks into rec, nil stops recording
+func (sr *SpeechRecognition) SetRecorder(rec *SessionRecorder) {
+	if sr.nls == nil {
+		return
+	}
+	sr.nls.setRecorder(rec)
+}
@@ -19,10 +19,13 @@ limitations under the License.
 package nls
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
 const (
@@ -39,30 +42,87 @@ const (
 	ST_SENTENCE_END_NAME   = "SentenceEnd"
 	ST_RESULT_CHG_NAME     = "TranscriptionResultChanged"
 	ST_COMPLETED_NAME      = "TranscriptionCompleted"
+
+	//the server answers a ControlTranscriber only when it fails
+	DEFAULT_CTRL_ACK_WINDOW = 2 * time.Second
 )
 
 type SpeechTranscriptionStartParam struct {
-	Format                         string `json:"format,omitempty"`
-	SampleRate                     int    `json:"sample_rate,omitempty"`
-	EnableIntermediateResult       bool   `json:"enable_intermediate_result"`
-	EnablePunctuationPrediction    bool   `json:"enable_punctuation_prediction"`
-	EnableInverseTextNormalization bool   `json:"enable_inverse_text_normalization"`
-	MaxSentenceSilence             int    `json:"max_sentence_silence,omitempty"`
-	EnableWords                    bool   `json:"enable_words"`
+	Format     string `json:"format,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	//nil fields are not sent, see Bool and Int
+	EnableIntermediateResult       *bool `json:"enable_intermediate_result,omitempty"`
+	EnablePunctuationPrediction    *bool `json:"enable_punctuation_prediction,omitempty"`
+	EnableInverseTextNormalization *bool `json:"enable_inverse_text_normalization,omitempty"`
+	MaxSentenceSilence             *int  `json:"max_sentence_silence,omitempty"`
+	EnableWords                    *bool `json:"enable_words,omitempty"`
+
+	VocabularyId                    string `json:"vocabulary_id,omitempty"`
+	CustomizationId                 string `json:"customization_id,omitempty"`
+	Disfluency                      *bool  `json:"disfluency,omitempty"`
+	EnableSemanticSentenceDetection *bool  `json:"enable_semantic_sentence_detection,omitempty"`
+	EnableIgnoreSentenceTimeout     *bool  `json:"enable_ignore_sentence_timeout,omitempty"`
+	//in [-1, 1], lower values treat more noise as speech, nil keeps the server default
+	SpeechNoiseThreshold *float64 `json:"speech_noise_threshold,omitempty"`
+}
+
+// Validate is called by Start before connecting.
+func (p SpeechTranscriptionStartParam) Validate() error {
+	err := checkSampleRate(p.SampleRate)
+	if err != nil {
+		return err
+	}
+	if p.MaxSentenceSilence != nil {
+		err = checkIntRange("max_sentence_silence", *p.MaxSentenceSilence, 200, 6000)
+		if err != nil {
+			return err
+		}
+	}
+	if p.SpeechNoiseThreshold != nil && (*p.SpeechNoiseThreshold < -1 || *p.SpeechNoiseThreshold > 1) {
+		return fmt.Errorf("invalid param: speech_noise_threshold %g out of range [-1, 1]", *p.SpeechNoiseThreshold)
+	}
+	//sentences are cut by meaning instead of silence then
+	if p.EnableSemanticSentenceDetection != nil && *p.EnableSemanticSentenceDetection && p.MaxSentenceSilence != nil {
+		return errors.New("invalid param: max_sentence_silence has no effect with enable_semantic_sentence_detection, leave it nil")
+	}
+	return nil
 }
 
 func DefaultSpeechTranscriptionParam() SpeechTranscriptionStartParam {
 	return SpeechTranscriptionStartParam{
 		Format:                         "pcm",
 		SampleRate:                     16000,
-		EnableIntermediateResult:       true,
-		EnablePunctuationPrediction:    true,
-		EnableInverseTextNormalization: true,
-		MaxSentenceSilence:             800,
-		EnableWords:                    false,
+		EnableIntermediateResult:       Bool(true),
+		EnablePunctuationPrediction:    Bool(true),
+		EnableInverseTextNormalization: Bool(true),
+		EnableWords:                    Bool(false),
 	}
 }
 
+// SpeechTranscriptionCtrlParam holds the options that can be changed while
+// transcribing, nil fields are left untouched.
+type SpeechTranscriptionCtrlParam struct {
+	MaxSentenceSilence       *int    `json:"max_sentence_silence,omitempty"`
+	VocabularyId             *string `json:"vocabulary_id,omitempty"`
+	EnableIntermediateResult *bool   `json:"enable_intermediate_result,omitempty"`
+}
+
+func (p SpeechTranscriptionCtrlParam) Validate() error {
+	if p.MaxSentenceSilence == nil && p.VocabularyId == nil && p.EnableIntermediateResult == nil {
+		return errors.New("ctrl: no option set")
+	}
+	if p.MaxSentenceSilence != nil {
+		err := checkIntRange("max_sentence_silence", *p.MaxSentenceSilence, 200, 6000)
+		if err != nil {
+			return err
+		}
+	}
+	if p.VocabularyId != nil && *p.VocabularyId == "" {
+		return errors.New("ctrl: empty vocabulary_id")
+	}
+	return nil
+}
+
 type SpeechTranscription struct {
 	nls    *nlsProto
 	taskId string
@@ -70,7 +130,18 @@ type SpeechTranscription struct {
 	startCh chan bool
 	stopCh  chan bool
 
-	lk sync.Mutex
+	lk      sync.Mutex
+	lastErr error
+	state   SessionState
+
+	events      *eventQueue
+	eventsOn    bool
+	eventBuffer int
+	eventPolicy EventOverflowPolicy
+
+	//controls sent whose rejection window is open, see Control
+	ctrls         []*ctrlWaiter
+	CtrlAckWindow time.Duration
 
 	onTaskFailed    func(text string, param interface{})
 	onStarted       func(text string, param interface{})
@@ -103,12 +174,26 @@ func checkStNlsProto(proto *nlsProto) *SpeechTranscription {
 
 func onStTaskFailedHandler(isErr bool, text []byte, proto *nlsProto) {
 	st := checkStNlsProto(proto)
+	taskErr := newTaskError(text)
+	st.lk.Lock()
+	starting := st.startCh != nil
+	st.lk.Unlock()
+	if starting && st.nls.retryStart(taskErr, st.failStart) {
+		return
+	}
+	st.nls.taskDone()
+
 	if st.onTaskFailed != nil {
 		st.onTaskFailed(string(text), st.UserParam)
 	}
+	st.emit(TRANSCRIPTION_FAILED, string(text), taskErr)
+	st.closeEvents()
 
 	st.lk.Lock()
 	defer st.lk.Unlock()
+	st.resolveCtrls(taskErr)
+	st.lastErr = taskErr
+	st.setState(SESSION_IDLE)
 
 	if st.startCh != nil {
 		st.startCh <- false
@@ -146,7 +231,29 @@ func onStCloseHandler(isErr bool, text []byte, proto *nlsProto) {
 		st.onClose(st.UserParam)
 	}
 
-	st.nls.shutdown()
+	//closes of superseded connections never get here, but a start being
+	//retried on a new connection still owns the state
+	if st.nls.retryPending() {
+		return
+	}
+	st.closeEvents()
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	st.resolveCtrls(errors.New("connection closed within ctrl window"))
+	st.setState(SESSION_CLOSED)
+	if st.startCh != nil {
+		st.lastErr = errors.New("connection closed before task started")
+		st.startCh <- false
+		close(st.startCh)
+		st.startCh = nil
+	}
+
+	if st.stopCh != nil {
+		st.lastErr = errors.New("connection closed before task completed")
+		st.stopCh <- false
+		close(st.stopCh)
+		st.stopCh = nil
+	}
 }
 
 func onStStartedHandler(isErr bool, text []byte, proto *nlsProto) {
@@ -154,8 +261,12 @@ func onStStartedHandler(isErr bool, text []byte, proto *nlsProto) {
 	if st.onStarted != nil {
 		st.onStarted(string(text), st.UserParam)
 	}
+	st.emit(TRANSCRIPTION_STARTED, string(text), nil)
 	st.lk.Lock()
 	defer st.lk.Unlock()
+	if st.state == SESSION_CONNECTING {
+		st.setState(SESSION_STARTED)
+	}
 	if st.startCh != nil {
 		st.startCh <- true
 		close(st.startCh)
@@ -168,6 +279,7 @@ func onStSentenceBeginHandler(isErr bool, text []byte, proto *nlsProto) {
 	if st.onSentenceBegin != nil {
 		st.onSentenceBegin(string(text), st.UserParam)
 	}
+	st.emit(TRANSCRIPTION_SENTENCE_BEGIN, string(text), nil)
 }
 
 func onStSentenceEndHandler(isErr bool, text []byte, proto *nlsProto) {
@@ -175,6 +287,7 @@ func onStSentenceEndHandler(isErr bool, text []byte, proto *nlsProto) {
 	if st.onSentenceEnd != nil {
 		st.onSentenceEnd(string(text), st.UserParam)
 	}
+	st.emit(TRANSCRIPTION_SENTENCE_END, string(text), nil)
 }
 
 func onStResultChangedHandler(isErr bool, text []byte, proto *nlsProto) {
@@ -182,18 +295,25 @@ func onStResultChangedHandler(isErr bool, text []byte, proto *nlsProto) {
 	if st.onResultChanged != nil {
 		st.onResultChanged(string(text), st.UserParam)
 	}
+	st.emit(TRANSCRIPTION_PARTIAL, string(text), nil)
 }
 
 func onStCompletedHandler(isErr bool, text []byte, proto *nlsProto) {
 	st := checkStNlsProto(proto)
+	st.nls.taskDone()
 	if st.onCompleted != nil {
 		st.onCompleted(string(text), st.UserParam)
 	}
+	st.emit(TRANSCRIPTION_COMPLETED, string(text), nil)
+	st.closeEvents()
 
 	st.lk.Lock()
 	defer st.lk.Unlock()
+	st.resolveCtrls(nil)
+	st.setState(SESSION_IDLE)
 	if st.stopCh != nil {
 		st.stopCh <- true
+		close(st.stopCh)
 		st.stopCh = nil
 	}
 }
@@ -268,6 +388,7 @@ func NewSpeechTranscription(config *ConnectionConfig,
 	st.onResultChanged = resultchanged
 	st.onCompleted = completed
 	st.onClose = closed
+	st.CtrlAckWindow = DEFAULT_CTRL_ACK_WINDOW
 	return st, nil
 }
 
@@ -280,42 +401,74 @@ func (st *SpeechTranscription) SetCustomHandler(name string, handler func(string
 }
 
 func (st *SpeechTranscription) Start(param SpeechTranscriptionStartParam, extra map[string]interface{}) (chan bool, error) {
+	return st.StartContext(context.Background(), param, extra)
+}
+
+// StartContext is Start bounded by ctx while waiting for the rate limiter
+// of the config and between connect attempts.
+func (st *SpeechTranscription) StartContext(ctx context.Context, param SpeechTranscriptionStartParam, extra map[string]interface{}) (chan bool, error) {
 	if st.nls == nil {
 		return nil, errors.New("empty nls: using NewSpeechTranscription to create a valid instance")
 	}
 
-	b, err := json.Marshal(param)
+	err := param.Validate()
 	if err != nil {
 		return nil, err
 	}
 
-	json.Unmarshal(b, &st.StartParam)
-	if extra != nil {
-		if st.StartParam == nil {
-			st.StartParam = extra
-		} else {
-			for k, v := range extra {
-				st.StartParam[k] = v
-			}
-		}
-	}
-	st.taskId = getUuid()
-	err = st.nls.Connect()
+	b, err := json.Marshal(param)
 	if err != nil {
 		return nil, err
 	}
 
-	st.lk.Lock()
-	defer st.lk.Unlock()
+	startParam := make(map[string]interface{})
+	json.Unmarshal(b, &startParam)
+	st.nls.applyDefaults(startParam)
+	for k, v := range extra {
+		startParam[k] = v
+	}
 
+	st.lk.Lock()
+	if st.state != SESSION_IDLE && st.state != SESSION_CLOSED {
+		state := st.state
+		st.lk.Unlock()
+		return nil, &StateError{Op: "Start", State: state}
+	}
+	st.setState(SESSION_CONNECTING)
+	st.StartParam = startParam
+	st.lastErr = nil
+	if st.eventsOn && (st.events == nil || st.events.isClosed()) {
+		st.events = newEventQueue(st.eventBuffer, st.eventPolicy)
+	}
 	st.startCh = make(chan bool, 1)
-	return st.startCh, nil
+	ch := st.startCh
+	st.lk.Unlock()
+
+	err = st.nls.startTask(ctx, func() string {
+		st.taskId = getUuid()
+		return st.taskId
+	})
+	if err != nil {
+		st.lk.Lock()
+		st.lastErr = err
+		if st.startCh == ch {
+			st.startCh = nil
+		}
+		st.setState(SESSION_CLOSED)
+		st.lk.Unlock()
+		return nil, err
+	}
+
+	return ch, nil
 }
 
 func (st *SpeechTranscription) Ctrl(param map[string]interface{}) error {
 	if st.nls == nil {
 		return errors.New("empty nls: using NewSpeechTranscription to create a valid instance")
 	}
+	if state := st.State(); state != SESSION_STARTED {
+		return &StateError{Op: "Ctrl", State: state}
+	}
 
 	req := CommonRequest{}
 	req.Context = DefaultContext
@@ -335,11 +488,80 @@ func (st *SpeechTranscription) Ctrl(param map[string]interface{}) error {
 	return nil
 }
 
+// Control validates param and sends it as ControlTranscriber. The server
+// does not acknowledge controls, so this is best-effort: the channel
+// receives the *TaskError if the server rejects the control, and nil when
+// CtrlAckWindow passed or the task completed without a rejection, which
+// does not prove the control was applied.
+func (st *SpeechTranscription) Control(param SpeechTranscriptionCtrlParam) (chan error, error) {
+	if st.nls == nil {
+		return nil, errors.New("empty nls: using NewSpeechTranscription to create a valid instance")
+	}
+	err := param.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(param)
+	if err != nil {
+		return nil, err
+	}
+	payload := make(map[string]interface{})
+	json.Unmarshal(b, &payload)
+
+	st.lk.Lock()
+	if st.state != SESSION_STARTED {
+		state := st.state
+		st.lk.Unlock()
+		return nil, &StateError{Op: "Control", State: state}
+	}
+	waiter := &ctrlWaiter{ch: make(chan error, 1)}
+	st.ctrls = append(st.ctrls, waiter)
+	st.lk.Unlock()
+
+	err = st.Ctrl(payload)
+	if err != nil {
+		st.lk.Lock()
+		st.dropCtrl(waiter)
+		st.lk.Unlock()
+		return nil, err
+	}
+
+	//the window starts once the control is on the wire
+	window := st.CtrlAckWindow
+	if window <= 0 {
+		window = DEFAULT_CTRL_ACK_WINDOW
+	}
+	st.lk.Lock()
+	if !waiter.done {
+		waiter.timer = time.AfterFunc(window, func() {
+			st.lk.Lock()
+			defer st.lk.Unlock()
+			if st.dropCtrl(waiter) {
+				waiter.resolve(nil)
+			}
+		})
+	}
+	st.lk.Unlock()
+	return waiter.ch, nil
+}
+
 func (st *SpeechTranscription) Stop() (chan bool, error) {
 	if st.nls == nil {
 		return nil, errors.New("empty nls: using NewSpeechTranscription to create a valid instance")
 	}
 
+	st.lk.Lock()
+	if st.state != SESSION_STARTED {
+		state := st.state
+		st.lk.Unlock()
+		return nil, &StateError{Op: "Stop", State: state}
+	}
+	st.setState(SESSION_STOPPING)
+	st.stopCh = make(chan bool, 1)
+	ch := st.stopCh
+	st.lk.Unlock()
+
 	req := CommonRequest{}
 	req.Context = DefaultContext
 	req.Header.Appkey = st.nls.connConfig.Appkey
@@ -351,13 +573,15 @@ func (st *SpeechTranscription) Stop() (chan bool, error) {
 	b, _ := json.Marshal(req)
 	err := st.nls.cmd(string(b))
 	if err != nil {
+		st.lk.Lock()
+		if st.stopCh == ch {
+			st.stopCh = nil
+		}
+		st.lk.Unlock()
 		return nil, err
 	}
 
-	st.lk.Lock()
-	defer st.lk.Unlock()
-	st.stopCh = make(chan bool, 1)
-	return st.stopCh, nil
+	return ch, nil
 }
 
 func (st *SpeechTranscription) Shutdown() {
@@ -365,9 +589,13 @@ func (st *SpeechTranscription) Shutdown() {
 		return
 	}
 
+	st.nls.cancelRetry()
 	st.nls.shutdown()
+	st.closeEvents()
 	st.lk.Lock()
 	defer st.lk.Unlock()
+	st.resolveCtrls(errors.New("shutdown within ctrl window"))
+	st.setState(SESSION_CLOSED)
 	if st.startCh != nil {
 		st.startCh <- false
 		close(st.startCh)
@@ -381,10 +609,192 @@ func (st *SpeechTranscription) Shutdown() {
 	}
 }
 
+// ShutdownContext is the graceful Shutdown: with sendStop a started task
+// is stopped, TranscriptionCompleted is awaited until ctx is done and the
+// connection closed with a close handshake. final reports whether the
+// completion arrived. It must not be called from the callbacks.
+func (st *SpeechTranscription) ShutdownContext(ctx context.Context, sendStop bool) (final bool, err error) {
+	if st.nls == nil {
+		return false, errors.New("empty nls: using NewSpeechTranscription to create a valid instance")
+	}
+
+	if sendStop && st.State() == SESSION_STARTED {
+		_, err = st.Stop()
+	}
+	if err == nil {
+		final, err = st.nls.waitTask(ctx)
+	}
+
+	st.nls.cancelRetry()
+	st.nls.closeGracefully(DEFAULT_CLOSE_TIMEOUT)
+	st.Shutdown()
+	return final, err
+}
+
 func (st *SpeechTranscription) SendAudioData(data []byte) error {
 	if st.nls == nil {
 		return errors.New("empty nls: using NewSpeechTranscription to create a valid instance")
 	}
+	if state := st.State(); state != SESSION_STARTED {
+		return &StateError{Op: "SendAudioData", State: state}
+	}
 
 	return st.nls.sendRawData(data)
 }
+
+func (st *SpeechTranscription) failStart(err error) {
+	st.emit(TRANSCRIPTION_FAILED, "", err)
+	st.closeEvents()
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	st.lastErr = err
+	st.setState(SESSION_CLOSED)
+	if st.startCh != nil {
+		st.startCh <- false
+		close(st.startCh)
+		st.startCh = nil
+	}
+}
+
+func (st *SpeechTranscription) State() SessionState {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	return st.state
+}
+
+// must be called with st.lk held
+func (st *SpeechTranscription) setState(state SessionState) {
+	if st.state != state {
+		st.nls.logger.Debugf("transcription %p state %s -> %s", st, st.state, state)
+	}
+	st.state = state
+}
+
+func (st *SpeechTranscription) LastError() error {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	return st.lastErr
+}
+
+func (st *SpeechTranscription) Endpoint() string {
+	if st.nls == nil {
+		return ""
+	}
+	return st.nls.currentEndpoint()
+}
+
+// buffer and overflow policy of the channel returned by Events, takes
+// effect from the next Start
+func (st *SpeechTranscription) SetEventOption(buffer int, policy EventOverflowPolicy) {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	st.eventBuffer = buffer
+	st.eventPolicy = policy
+}
+
+// channel alternative to the callbacks, delivered off the websocket read
+// goroutine and closed at the end of each session. Call it before Start
+// to see every event, a new channel is returned for the next session.
+func (st *SpeechTranscription) Events() <-chan TranscriptionEvent {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	if !st.eventsOn {
+		st.eventsOn = true
+		if st.eventBuffer <= 0 {
+			st.eventBuffer = DEFAULT_EVENT_BUFFER
+		}
+	}
+	if st.events == nil || st.events.isClosed() {
+		st.events = newEventQueue(st.eventBuffer, st.eventPolicy)
+	}
+	return st.events.ch
+}
+
+func (st *SpeechTranscription) DroppedEvents() int {
+	st.lk.Lock()
+	q := st.events
+	st.lk.Unlock()
+	if q == nil {
+		return 0
+	}
+	return q.droppedCount()
+}
+
+func (st *SpeechTranscription) emit(t TranscriptionEventType, text string, err error) {
+	st.lk.Lock()
+	q := st.events
+	st.lk.Unlock()
+	if q == nil {
+		return
+	}
+	q.push(TranscriptionEvent{Type: t, Text: text, Err: err, Time: time.Now()})
+}
+
+// closed is the last event of every session, however it ended
+func (st *SpeechTranscription) closeEvents() {
+	st.lk.Lock()
+	q := st.events
+	st.lk.Unlock()
+	if q == nil || q.isClosed() {
+		return
+	}
+	q.push(TranscriptionEvent{Type: TRANSCRIPTION_CLOSED, Time: time.Now()})
+	q.close()
+}
+
+func (st *SpeechTranscription) SetConnectionMux(mux *ConnectionMux) error {
+	if st.nls == nil {
+		return errors.New("empty nls: using NewSpeechTranscription to create a valid instance")
+	}
+	if mux == nil {
+		st.nls.setSource(nil)
+		return nil
+	}
+	st.nls.setSource(mux)
+	return nil
+}
+
+type ctrlWaiter struct {
+	ch    chan error
+	timer *time.Timer
+	done  bool
+}
+
+func (w *ctrlWaiter) resolve(err error) {
+	if w.done {
+		return
+	}
+	w.done = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.ch <- err
+	close(w.ch)
+}
+
+// must be called with st.lk held
+func (st *SpeechTranscription) dropCtrl(waiter *ctrlWaiter) bool {
+	for i, w := range st.ctrls {
+		if w == waiter {
+			st.ctrls = append(st.ctrls[:i], st.ctrls[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// must be called with st.lk held
+func (st *SpeechTranscription) resolveCtrls(err error) {
+	for _, w := range st.ctrls {
+		w.resolve(err)
+	}
+	st.ctrls = nil
+}
+
+// archive every frame of the following tasks into rec, nil stops recording
+func (st *SpeechTranscription) SetRecorder(rec *SessionRecorder) {
+	if st.nls == nil {
+		return
+	}
+	st.nls.setRecorder(rec)
+}
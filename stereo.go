@@ -0,0 +1,448 @@
+/*
+stereo.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_STEREO_CHUNK_MS     = 100
+	DEFAULT_STEREO_STOP_TIMEOUT = 10 * time.Second
+
+	wavFormatPcm        = 1
+	wavFormatExtensible = 0xfffe
+)
+
+type WavHeader struct {
+	AudioFormat   uint16
+	Channels      uint16
+	SampleRate    uint32
+	BitsPerSample uint16
+	//bytes of the data chunk, 0 or 0xffffffff when the writer did not know
+	DataSize uint32
+}
+
+// ReadWavHeader reads up to the start of the data chunk, chunks other than
+// fmt are skipped.
+func ReadWavHeader(r io.Reader) (*WavHeader, error) {
+	riff := make([]byte, 12)
+	_, err := io.ReadFull(r, riff)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(riff[:4], []byte("RIFF")) || !bytes.Equal(riff[8:], []byte("WAVE")) {
+		return nil, errors.New("wav: not a RIFF/WAVE file")
+	}
+
+	header := new(WavHeader)
+	hasFmt := false
+	chunk := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(r, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("wav: no data chunk: %w", err)
+		}
+		id := string(chunk[:4])
+		size := binary.LittleEndian.Uint32(chunk[4:])
+
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("wav: short fmt chunk")
+			}
+			body := make([]byte, size+size&1)
+			_, err = io.ReadFull(r, body)
+			if err != nil {
+				return nil, err
+			}
+			header.AudioFormat = binary.LittleEndian.Uint16(body[0:2])
+			header.Channels = binary.LittleEndian.Uint16(body[2:4])
+			header.SampleRate = binary.LittleEndian.Uint32(body[4:8])
+			header.BitsPerSample = binary.LittleEndian.Uint16(body[14:16])
+			hasFmt = true
+		case "data":
+			if !hasFmt {
+				return nil, errors.New("wav: data chunk before fmt chunk")
+			}
+			header.DataSize = size
+			return header, nil
+		default:
+			_, err = io.CopyN(ioutil.Discard, r, int64(size+size&1))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// SplitStereoPcm splits interleaved 16 bit stereo pcm into two mono
+// buffers, a trailing partial frame is dropped.
+func SplitStereoPcm(data []byte) ([]byte, []byte) {
+	frames := len(data) / 4
+	left := make([]byte, 2*frames)
+	right := make([]byte, 2*frames)
+	for i := 0; i < frames; i++ {
+		copy(left[2*i:], data[4*i:4*i+2])
+		copy(right[2*i:], data[4*i+2:4*i+4])
+	}
+	return left, right
+}
+
+// StereoSentence is one SentenceEnd of a channel, times are ms from the
+// start of the recording.
+type StereoSentence struct {
+	Channel   int
+	Speaker   string
+	Index     int
+	BeginTime int
+	EndTime   int
+	Text      string
+	//the SentenceEnd message
+	Raw string
+}
+
+type StereoTranscriptionResult struct {
+	//ordered by BeginTime, then by channel
+	Sentences []StereoSentence
+	//failure of each channel, nil for a channel that completed
+	Errors [2]error
+}
+
+// StereoTranscriber transcribes a two channel recording with one
+// SpeechTranscription per channel. Both sessions get their audio in
+// lockstep so the times of their sentences share one timeline.
+type StereoTranscriber struct {
+	//speaker names of channel 0 and 1
+	Speakers [2]string
+	ChunkMs  int
+	//multiple of real time to send at, 0 sends as fast as possible
+	Speed       float64
+	StopTimeout time.Duration
+	//called for every sentence as it arrives, from the goroutine of its
+	//channel but never concurrently
+	OnSentence func(sentence StereoSentence)
+
+	config *ConnectionConfig
+	logger *NlsLogger
+	param  SpeechTranscriptionStartParam
+	extra  map[string]interface{}
+
+	lk sync.Mutex
+}
+
+// Format of param is set to pcm, SampleRate is taken from the audio.
+func NewStereoTranscriber(config *ConnectionConfig,
+	logger *NlsLogger,
+	param SpeechTranscriptionStartParam,
+	extra map[string]interface{}) (*StereoTranscriber, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	if logger == nil {
+		logger = DefaultNlsLog()
+	}
+
+	t := new(StereoTranscriber)
+	t.Speakers = [2]string{"left", "right"}
+	t.ChunkMs = DEFAULT_STEREO_CHUNK_MS
+	t.Speed = 1
+	t.StopTimeout = DEFAULT_STEREO_STOP_TIMEOUT
+	t.config = config
+	t.logger = logger
+	t.param = param
+	t.param.Format = PCM
+	t.extra = extra
+	return t, nil
+}
+
+// TranscribeWav transcribes a 16 bit pcm stereo wav.
+func (t *StereoTranscriber) TranscribeWav(ctx context.Context, r io.Reader) (*StereoTranscriptionResult, error) {
+	header, err := ReadWavHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.AudioFormat != wavFormatPcm && header.AudioFormat != wavFormatExtensible {
+		return nil, fmt.Errorf("wav: unsupported audio format %d", header.AudioFormat)
+	}
+	if header.Channels != 2 || header.BitsPerSample != 16 {
+		return nil, fmt.Errorf("wav: %d channels of %d bit, expect 2 of 16 bit", header.Channels, header.BitsPerSample)
+	}
+
+	if header.DataSize != 0 && header.DataSize != 0xffffffff {
+		r = io.LimitReader(r, int64(header.DataSize))
+	}
+	return t.Transcribe(ctx, r, int(header.SampleRate))
+}
+
+type stereoChannel struct {
+	index   int
+	st      *SpeechTranscription
+	events  <-chan TranscriptionEvent
+	started chan bool
+	//the event loop has finished
+	done chan struct{}
+	err  error
+}
+
+func (ch *stereoChannel) alive() bool {
+	return ch.err == nil
+}
+
+// fail keeps the first error of the channel and ends its session
+func (ch *stereoChannel) fail(err error) {
+	if ch.err != nil {
+		return
+	}
+	if lastErr := ch.st.LastError(); lastErr != nil {
+		err = lastErr
+	}
+	ch.err = err
+	ch.st.Shutdown()
+}
+
+// Transcribe transcribes interleaved 16 bit stereo pcm. A failing channel
+// does not stop the other one, an error is returned only if both failed
+// or ctx is done, with the sentences received so far.
+func (t *StereoTranscriber) Transcribe(ctx context.Context, r io.Reader, sampleRate int) (*StereoTranscriptionResult, error) {
+	param := t.param
+	param.SampleRate = sampleRate
+	err := param.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(StereoTranscriptionResult)
+	var channels [2]*stereoChannel
+	for i := range channels {
+		st, err := NewSpeechTranscription(t.config, t.logger,
+			nil, nil, nil, nil, nil, nil, nil, i)
+		if err != nil {
+			return nil, err
+		}
+		//collect drains without pause and must not lose a sentence
+		st.SetEventOption(DEFAULT_EVENT_BUFFER, EVENT_OVERFLOW_BLOCK)
+		ch := &stereoChannel{index: i, st: st, events: st.Events(), done: make(chan struct{})}
+		channels[i] = ch
+		go t.collect(ch, result)
+	}
+
+	for _, ch := range channels {
+		ch.started, err = ch.st.StartContext(ctx, param, t.extra)
+		if err != nil {
+			ch.fail(err)
+		}
+	}
+	for _, ch := range channels {
+		if !ch.alive() {
+			continue
+		}
+		select {
+		case ok := <-ch.started:
+			if !ok {
+				ch.fail(errors.New("start failed"))
+			}
+		case <-ctx.Done():
+			return t.finish(result, channels), ctx.Err()
+		}
+	}
+
+	err = t.send(ctx, r, sampleRate, channels)
+	if err != nil {
+		return t.finish(result, channels), err
+	}
+	t.stop(channels)
+
+	result = t.finish(result, channels)
+	if result.Errors[0] != nil && result.Errors[1] != nil {
+		return result, fmt.Errorf("both channels failed: %s: %v; %s: %v",
+			t.Speakers[0], result.Errors[0], t.Speakers[1], result.Errors[1])
+	}
+	return result, nil
+}
+
+func (t *StereoTranscriber) send(ctx context.Context, r io.Reader, sampleRate int, channels [2]*stereoChannel) error {
+	chunkMs := t.ChunkMs
+	if chunkMs <= 0 {
+		chunkMs = DEFAULT_STEREO_CHUNK_MS
+	}
+	bytesPerMs := sampleRate * 4 / 1000
+	chunk := make([]byte, bytesPerMs*chunkMs)
+	total := 0
+	start := time.Now()
+
+	for channels[0].alive() || channels[1].alive() {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			left, right := SplitStereoPcm(chunk[:n])
+			for i, data := range [2][]byte{left, right} {
+				ch := channels[i]
+				if !ch.alive() {
+					continue
+				}
+				serr := ch.st.SendAudioData(data)
+				if serr != nil {
+					ch.fail(serr)
+				}
+			}
+			total += n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if t.Speed > 0 {
+			sent := time.Duration(float64(total/bytesPerMs)/t.Speed) * time.Millisecond
+			if wait := sent - time.Since(start); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (t *StereoTranscriber) stop(channels [2]*stereoChannel) {
+	timeout := t.StopTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_STEREO_STOP_TIMEOUT
+	}
+
+	var stopped [2]chan bool
+	for i, ch := range channels {
+		if !ch.alive() {
+			continue
+		}
+		done, err := ch.st.Stop()
+		if err != nil {
+			ch.fail(err)
+			continue
+		}
+		stopped[i] = done
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for i, done := range stopped {
+		if done == nil {
+			continue
+		}
+		select {
+		case ok := <-done:
+			if !ok {
+				channels[i].fail(errors.New("stop failed"))
+			}
+		case <-timer.C:
+			channels[i].fail(errors.New("timeout waiting for TranscriptionCompleted"))
+		}
+	}
+}
+
+// finish ends both sessions and waits until their sentences are collected
+func (t *StereoTranscriber) finish(result *StereoTranscriptionResult, channels [2]*stereoChannel) *StereoTranscriptionResult {
+	for _, ch := range channels {
+		ch.st.Shutdown()
+		<-ch.done
+	}
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	for i, ch := range channels {
+		if result.Errors[i] == nil {
+			result.Errors[i] = ch.err
+		}
+	}
+	sort.SliceStable(result.Sentences, func(i, j int) bool {
+		a, b := result.Sentences[i], result.Sentences[j]
+		if a.BeginTime != b.BeginTime {
+			return a.BeginTime < b.BeginTime
+		}
+		return a.Channel < b.Channel
+	})
+	return result
+}
+
+func (t *StereoTranscriber) collect(ch *stereoChannel, result *StereoTranscriptionResult) {
+	defer close(ch.done)
+	for ev := range ch.events {
+		switch ev.Type {
+		case TRANSCRIPTION_SENTENCE_END:
+			sentence, err := t.parseSentence(ch.index, ev.Text)
+			if err != nil {
+				t.logger.Println("invalid SentenceEnd:", err)
+				continue
+			}
+			t.lk.Lock()
+			result.Sentences = append(result.Sentences, sentence)
+			if t.OnSentence != nil {
+				t.OnSentence(sentence)
+			}
+			t.lk.Unlock()
+		case TRANSCRIPTION_FAILED:
+			//kept apart from ch.err, which belongs to the sending goroutine
+			t.lk.Lock()
+			if result.Errors[ch.index] == nil {
+				result.Errors[ch.index] = ev.Err
+			}
+			t.lk.Unlock()
+		}
+	}
+}
+
+func (t *StereoTranscriber) parseSentence(channel int, text string) (StereoSentence, error) {
+	resp := CommonResponse{}
+	err := json.Unmarshal([]byte(text), &resp)
+	if err != nil {
+		return StereoSentence{}, err
+	}
+
+	sentence := StereoSentence{Channel: channel, Speaker: t.Speakers[channel], Raw: text}
+	sentence.Text, _ = resp.Payload["result"].(string)
+	if v, ok := resp.Payload["index"].(float64); ok {
+		sentence.Index = int(v)
+	}
+	if v, ok := resp.Payload["begin_time"].(float64); ok {
+		sentence.BeginTime = int(v)
+	}
+	if v, ok := resp.Payload["time"].(float64); ok {
+		sentence.EndTime = int(v)
+	}
+	return sentence, nil
+}
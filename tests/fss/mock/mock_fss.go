@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aliyun/alibabacloud-nls-go-sdk"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+)
+
+//mock of the FlowingSpeechSynthesizer service, speaks the same message
+//flow as the gateway and answers every character with 20ms of silence
+
+const (
+	SAMPLE_RATE = 16000
+	MS_PER_CHAR = 20
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type session struct {
+	conn     *websocket.Conn
+	taskId   string
+	appkey   string
+	index    int
+	rate     int
+	finished bool
+}
+
+func (s *session) event(name string, payload map[string]interface{}) {
+	resp := nls.CommonResponse{}
+	resp.Header.MessageId = strings.ReplaceAll(uuid.NewV4().String(), "-", "")
+	resp.Header.TaskId = s.taskId
+	resp.Header.Namespace = nls.FSS_NAMESPACE
+	resp.Header.Name = name
+	resp.Header.Appkey = s.appkey
+	resp.Header.Status = 20000000
+	resp.Header.StatusText = "Gateway:SUCCESS:Success."
+	resp.Payload = payload
+
+	b, _ := json.Marshal(resp)
+	s.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func (s *session) fail(status int, text string) {
+	resp := nls.CommonResponse{}
+	resp.Header.TaskId = s.taskId
+	resp.Header.Namespace = "Default"
+	resp.Header.Name = nls.TASK_FAILED_NAME
+	resp.Header.Status = status
+	resp.Header.StatusText = text
+
+	b, _ := json.Marshal(resp)
+	s.conn.WriteMessage(websocket.TextMessage, b)
+	s.finished = true
+}
+
+func (s *session) synthesize(text string) {
+	for _, sentence := range splitSentences(text) {
+		s.index++
+		s.event(nls.FSS_SENTENCE_BEGIN_NAME, map[string]interface{}{"index": s.index})
+
+		chars := utf8.RuneCountInString(sentence)
+		samples := s.rate * MS_PER_CHAR / 1000 * chars
+		s.conn.WriteMessage(websocket.BinaryMessage, make([]byte, samples*2))
+
+		s.event(nls.FSS_SENTENCE_SYNTHESIS_NAME, map[string]interface{}{
+			"subtitles": []map[string]interface{}{
+				{"text": sentence, "begin_time": 0, "end_time": chars * MS_PER_CHAR},
+			},
+		})
+		s.event(nls.FSS_SENTENCE_END_NAME, map[string]interface{}{
+			"index": s.index,
+			"subtitles": []map[string]interface{}{
+				{"text": sentence, "begin_time": 0, "end_time": chars * MS_PER_CHAR},
+			},
+		})
+	}
+}
+
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	for i, r := range text {
+		if strings.ContainsRune("。！？!?.\n", r) {
+			end := i + utf8.RuneLen(r)
+			if s := strings.TrimSpace(text[start:end]); s != "" {
+				sentences = append(sentences, s)
+			}
+			start = end
+		}
+	}
+	if s := strings.TrimSpace(text[start:]); s != "" {
+		sentences = append(sentences, s)
+	}
+	return sentences
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(nls.DEFAULT_X_NLS_TOKEN_KEY) == "" {
+		http.Error(w, "missing token", http.StatusForbidden)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade:", err)
+		return
+	}
+	defer conn.Close()
+
+	s := &session{conn: conn, rate: SAMPLE_RATE}
+	for !s.finished {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if mt != websocket.TextMessage {
+			s.fail(40000000, "binary data not expected")
+			continue
+		}
+
+		req := nls.CommonRequest{}
+		err = json.Unmarshal(data, &req)
+		if err != nil {
+			s.fail(40000000, "invalid json")
+			continue
+		}
+		log.Printf("recv %s task %s", req.Header.Name, req.Header.TaskId)
+		if req.Header.Namespace != nls.FSS_NAMESPACE {
+			s.fail(40000000, "unknown namespace "+req.Header.Namespace)
+			continue
+		}
+
+		switch req.Header.Name {
+		case nls.FSS_START_NAME:
+			s.taskId = req.Header.TaskId
+			s.appkey = req.Header.Appkey
+			if rate, ok := req.Payload["sample_rate"].(float64); ok && rate > 0 {
+				s.rate = int(rate)
+			}
+			s.event(nls.FSS_STARTED_NAME, map[string]interface{}{"session_id": s.taskId})
+		case nls.FSS_RUN_NAME:
+			if req.Header.TaskId != s.taskId {
+				s.fail(40000000, "task id mismatch")
+				continue
+			}
+			text, _ := req.Payload["text"].(string)
+			s.synthesize(text)
+		case nls.FSS_STOP_NAME:
+			s.event(nls.FSS_COMPLETED_NAME, nil)
+			s.finished = true
+		default:
+			s.fail(40000000, "unknown name "+req.Header.Name)
+		}
+	}
+
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	time.Sleep(100 * time.Millisecond)
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "listen address")
+	flag.Parse()
+
+	http.HandleFunc("/ws/v1", serve)
+	log.Printf("mock FlowingSpeechSynthesizer on ws://%s/ws/v1", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
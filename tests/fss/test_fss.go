@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aliyun/alibabacloud-nls-go-sdk"
+)
+
+const (
+	AKID  = "Your AKID"
+	AKKEY = "Your AKKEY"
+	//online key
+	APPKEY = "Your APPKEY"
+	TOKEN  = "TEST TOKEN"
+)
+
+// simulates a chatbot answer arriving a few characters at a time
+const (
+	TEXT = "你好，我是你的智能助手。今天上海天气晴，气温二十度左右，适合出门散步！还有什么可以帮你的吗？"
+)
+
+type FssUserParam struct {
+	F      io.Writer
+	Logger *nls.NlsLogger
+}
+
+func userParam(param interface{}) *FssUserParam {
+	p, ok := param.(*FssUserParam)
+	if !ok {
+		log.Default().Fatal("invalid logger")
+		return nil
+	}
+	return p
+}
+
+func onTaskFailed(text string, param interface{}) {
+	userParam(param).Logger.Println("TaskFailed:", text)
+}
+
+func onStarted(text string, param interface{}) {
+	userParam(param).Logger.Println("onStarted:", text)
+}
+
+func onSentenceBegin(text string, param interface{}) {
+	userParam(param).Logger.Println("onSentenceBegin:", text)
+}
+
+func onSentenceSynthesis(text string, param interface{}) {
+	userParam(param).Logger.Println("onSentenceSynthesis:", text)
+}
+
+func onSentenceEnd(text string, param interface{}) {
+	userParam(param).Logger.Println("onSentenceEnd:", text)
+}
+
+func onSynthesisResult(data []byte, param interface{}) {
+	userParam(param).F.Write(data)
+}
+
+func onCompleted(text string, param interface{}) {
+	userParam(param).Logger.Println("onCompleted:", text)
+}
+
+func onClose(param interface{}) {
+	userParam(param).Logger.Println("onClosed:")
+}
+
+func waitReady(ch chan bool, logger *nls.NlsLogger) error {
+	select {
+	case done := <-ch:
+		{
+			if !done {
+				logger.Println("Wait failed")
+				return errors.New("wait failed")
+			}
+			logger.Println("Wait done")
+		}
+	case <-time.After(60 * time.Second):
+		{
+			logger.Println("Wait timeout")
+			return errors.New("wait timeout")
+		}
+	}
+	return nil
+}
+
+func main() {
+	url := flag.String("url", nls.DEFAULT_URL, "gateway url, e.g. ws://127.0.0.1:8080/ws/v1 for tests/fss/mock")
+	out := flag.String("out", "fssdump.pcm", "audio output file")
+	flag.Parse()
+
+	logger := nls.NewNlsLogger(os.Stderr, "FSS ", log.LstdFlags|log.Lmicroseconds)
+	logger.SetLogSil(false)
+	logger.SetDebug(true)
+
+	fout, err := os.OpenFile(*out, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0666)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	defer fout.Close()
+
+	fssUserParam := new(FssUserParam)
+	fssUserParam.F = fout
+	fssUserParam.Logger = logger
+
+	config := nls.NewConnectionConfigWithToken(*url, APPKEY, TOKEN)
+	fss, err := nls.NewFlowingSpeechSynthesis(config, logger,
+		onTaskFailed, onStarted, onSentenceBegin, onSentenceSynthesis,
+		onSentenceEnd, onSynthesisResult, onCompleted, onClose, fssUserParam)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	ch, err := fss.Start(nls.DefaultFlowingSpeechSynthesisParam(), nil)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+	if err = waitReady(ch, logger); err != nil {
+		fss.Shutdown()
+		logger.Fatalln(err)
+	}
+
+	runes := []rune(TEXT)
+	for i := 0; i < len(runes); i += 3 {
+		end := i + 3
+		if end > len(runes) {
+			end = len(runes)
+		}
+		err = fss.SendText(string(runes[i:end]))
+		if err != nil {
+			logger.Println("SendText failed:", err)
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ch, err = fss.Stop()
+	if err != nil {
+		fss.Shutdown()
+		logger.Fatalln(err)
+	}
+	if err = waitReady(ch, logger); err != nil {
+		logger.Println("Stop failed:", err)
+	}
+	logger.Println("Synthesis done")
+	fss.Shutdown()
+}
@@ -20,35 +20,17 @@ limitations under the License.
 
 package nls
 
-import (
-	"encoding/json"
-  "github.com/aliyun/alibaba-cloud-sdk-go/sdk"
-	"github.com/aliyun/alibaba-cloud-sdk-go/sdk/requests"
-)
-
 func GetToken(dist string, domain string, akid string, akkey string, version string) (*TokenResultMessage, error) {
-	client, err := sdk.NewClientWithAccessKey(dist, akid, akkey)
-	if err != nil {
-		return nil, err
-	}
-
-	request := requests.NewCommonRequest()
-	request.Method = "POST"
-	request.Domain = domain
-	request.ApiName = "CreateToken"
-	request.Version = version
-	response, err := client.ProcessCommonRequest(request)
+	pop, err := newPopClient(dist, akid, akkey, domain, version)
 	if err != nil {
 		return nil, err
 	}
 
 	message := new(TokenResultMessage)
-	err = json.Unmarshal(response.GetHttpContentBytes(), message)
+	err = pop.call("CreateToken", nil, message)
 	if err != nil {
 		return nil, err
 	}
 
 	return message, nil
 }
-
-
@@ -19,6 +19,7 @@ limitations under the License.
 package nls
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
@@ -36,13 +37,14 @@ const (
 )
 
 type SpeechSynthesisStartParam struct {
-	Voice          string `json:"voice"`
-	Format         string `json:"format,omitempty"`
-	SampleRate     int    `json:"sample_rate,omitempty"`
-	Volume         int    `json:"volume"`
-	SpeechRate     int    `json:"speech_rate"`
-	PitchRate      int    `json:"pitch_rate"`
-	EnableSubtitle bool   `json:"enable_subtitle"`
+	Voice      string `json:"voice"`
+	Format     string `json:"format,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	//nil fields are not sent, see Bool and Int
+	Volume         *int  `json:"volume,omitempty"`
+	SpeechRate     *int  `json:"speech_rate,omitempty"`
+	PitchRate      *int  `json:"pitch_rate,omitempty"`
+	EnableSubtitle *bool `json:"enable_subtitle,omitempty"`
 }
 
 func DefaultSpeechSynthesisParam() SpeechSynthesisStartParam {
@@ -50,10 +52,10 @@ func DefaultSpeechSynthesisParam() SpeechSynthesisStartParam {
 		Voice:          "xiaoyun",
 		Format:         "wav",
 		SampleRate:     16000,
-		Volume:         50,
-		SpeechRate:     0,
-		PitchRate:      0,
-		EnableSubtitle: false,
+		Volume:         Int(50),
+		SpeechRate:     Int(0),
+		PitchRate:      Int(0),
+		EnableSubtitle: Bool(false),
 	}
 }
 
@@ -63,6 +65,9 @@ type SpeechSynthesis struct {
 
 	completeChan chan bool
 	lk           sync.Mutex
+	lastErr      error
+	//audio already arrived, a failure can no longer be retried
+	received bool
 
 	onTaskFailed      func(text string, param interface{})
 	onSynthesisResult func(data []byte, param interface{})
@@ -93,12 +98,22 @@ func checkTtsNlsProto(proto *nlsProto) *SpeechSynthesis {
 
 func onTtsTaskFailedHandler(isErr bool, text []byte, proto *nlsProto) {
 	tts := checkTtsNlsProto(proto)
+	taskErr := newTaskError(text)
+	tts.lk.Lock()
+	starting := tts.completeChan != nil && !tts.received
+	tts.lk.Unlock()
+	if starting && tts.nls.retryStart(taskErr, tts.failStart) {
+		return
+	}
+	tts.nls.taskDone()
+
 	if tts.onTaskFailed != nil {
 		tts.onTaskFailed(string(text), tts.UserParam)
 	}
 
 	tts.lk.Lock()
 	defer tts.lk.Unlock()
+	tts.lastErr = taskErr
 	if tts.completeChan != nil {
 		tts.completeChan <- false
 		close(tts.completeChan)
@@ -145,6 +160,9 @@ func onTtsMetaInfoHandler(isErr bool, text []byte, proto *nlsProto) {
 
 func onTtsRawResultHandler(isErr bool, text []byte, proto *nlsProto) {
 	tts := checkTtsNlsProto(proto)
+	tts.lk.Lock()
+	tts.received = true
+	tts.lk.Unlock()
 	if tts.onSynthesisResult != nil {
 		tts.onSynthesisResult(text, tts.UserParam)
 	}
@@ -152,6 +170,7 @@ func onTtsRawResultHandler(isErr bool, text []byte, proto *nlsProto) {
 
 func onTtsCompletedHandler(isErr bool, text []byte, proto *nlsProto) {
 	tts := checkTtsNlsProto(proto)
+	tts.nls.taskDone()
 	if tts.onCompleted != nil {
 		tts.onCompleted(string(text), tts.UserParam)
 	}
@@ -216,6 +235,15 @@ func NewSpeechSynthesis(config *ConnectionConfig,
 }
 
 func (tts *SpeechSynthesis) Start(text string,
+	param SpeechSynthesisStartParam,
+	extra map[string]interface{}) (chan bool, error) {
+	return tts.StartContext(context.Background(), text, param, extra)
+}
+
+// StartContext is Start bounded by ctx while waiting for the rate limiter
+// of the config and between connect attempts.
+func (tts *SpeechSynthesis) StartContext(ctx context.Context,
+	text string,
 	param SpeechSynthesisStartParam,
 	extra map[string]interface{}) (chan bool, error) {
 	if tts.nls == nil {
@@ -227,27 +255,51 @@ func (tts *SpeechSynthesis) Start(text string,
 		return nil, err
 	}
 
-	json.Unmarshal(b, &tts.StartParam)
-	if extra != nil {
-		if tts.StartParam == nil {
-			tts.StartParam = extra
-		} else {
-			for k, v := range extra {
-				tts.StartParam[k] = v
-			}
-		}
+	startParam := make(map[string]interface{})
+	json.Unmarshal(b, &startParam)
+	tts.nls.applyDefaults(startParam)
+	for k, v := range extra {
+		startParam[k] = v
 	}
+	tts.StartParam = startParam
 	tts.StartParam["text"] = text
-	tts.taskId = getUuid()
-	err = tts.nls.Connect()
+	tts.lk.Lock()
+	tts.lastErr = nil
+	tts.received = false
+	tts.completeChan = make(chan bool, 1)
+	ch := tts.completeChan
+	tts.lk.Unlock()
+
+	err = tts.nls.startTask(ctx, func() string {
+		tts.taskId = getUuid()
+		return tts.taskId
+	})
 	if err != nil {
+		tts.lk.Lock()
+		tts.lastErr = err
+		if tts.completeChan == ch {
+			tts.completeChan = nil
+		}
+		tts.lk.Unlock()
 		return nil, err
 	}
 
-	tts.lk.Lock()
-	defer tts.lk.Unlock()
-	tts.completeChan = make(chan bool, 1)
-	return tts.completeChan, nil
+	return ch, nil
+}
+
+// ShutdownContext waits up to ctx for SynthesisCompleted, then closes
+// with a close handshake, final reports whether it arrived. Not for use
+// inside the callbacks.
+func (tts *SpeechSynthesis) ShutdownContext(ctx context.Context) (final bool, err error) {
+	if tts.nls == nil {
+		return false, errors.New("empty nls: using NewSpeechSynthesis to create a valid instance")
+	}
+
+	final, err = tts.nls.waitTask(ctx)
+	tts.nls.cancelRetry()
+	tts.nls.closeGracefully(DEFAULT_CLOSE_TIMEOUT)
+	tts.Shutdown()
+	return final, err
 }
 
 func (tts *SpeechSynthesis) Shutdown() {
@@ -255,6 +307,7 @@ func (tts *SpeechSynthesis) Shutdown() {
 		return
 	}
 
+	tts.nls.cancelRetry()
 	tts.lk.Lock()
 	defer tts.lk.Unlock()
 	tts.nls.shutdown()
@@ -264,3 +317,60 @@ func (tts *SpeechSynthesis) Shutdown() {
 		tts.completeChan = nil
 	}
 }
+
+func (tts *SpeechSynthesis) failStart(err error) {
+	tts.lk.Lock()
+	defer tts.lk.Unlock()
+	tts.lastErr = err
+	if tts.completeChan != nil {
+		tts.completeChan <- false
+		close(tts.completeChan)
+		tts.completeChan = nil
+	}
+}
+
+func (tts *SpeechSynthesis) LastError() error {
+	tts.lk.Lock()
+	defer tts.lk.Unlock()
+	return tts.lastErr
+}
+
+func (tts *SpeechSynthesis) Endpoint() string {
+	if tts.nls == nil {
+		return ""
+	}
+	return tts.nls.currentEndpoint()
+}
+
+func (tts *SpeechSynthesis) SetConnectionMux(mux *ConnectionMux) error {
+	if tts.nls == nil {
+		return errors.New("empty nls: using NewSpeechSynthesis to create a valid instance")
+	}
+	if mux == nil {
+		tts.nls.setSource(nil)
+		return nil
+	}
+	tts.nls.setSource(mux)
+	return nil
+}
+
+// take warm connections from pool instead of dialing on every Start
+func (tts *SpeechSynthesis) SetConnectionPool(pool *ConnectionPool) error {
+	if tts.nls == nil {
+		return errors.New("empty nls: using NewSpeechSynthesis to create a valid instance")
+	}
+	if pool == nil {
+		tts.nls.setSource(nil)
+		return nil
+	}
+	tts.nls.setSource(pool)
+	return nil
+}
+
+// archive every frame of the following tasks into rec, nil stops recording
+func (tts *SpeechSynthesis) SetRecorder(rec *SessionRecorder) {
+	if tts.nls == nil {
+		return
+	}
+	tts.nls.setRecorder(rec)
+}
@@ -0,0 +1,577 @@
+/*
+ttscache.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_TTS_CACHE_TIMEOUT = 60 * time.Second
+
+	ttsCacheAudioExt = ".audio"
+	ttsCacheMetaExt  = ".json"
+)
+
+// TtsCacheEntry is the outcome of one synthesis. Entries are shared
+// between callers and must not be modified.
+type TtsCacheEntry struct {
+	Audio []byte
+	//MetaInfo messages in arrival order, they carry the subtitles
+	MetaInfo []string
+	Created  time.Time
+}
+
+func (e *TtsCacheEntry) size() int64 {
+	size := int64(len(e.Audio))
+	for _, m := range e.MetaInfo {
+		size += int64(len(m))
+	}
+	return size
+}
+
+// TtsCacheBackend stores entries by key, Get must not return expired
+// entries.
+type TtsCacheBackend interface {
+	Get(key string) (*TtsCacheEntry, bool)
+	Put(key string, entry *TtsCacheEntry) error
+}
+
+// TtsCacheKey hashes everything that changes the synthesized audio.
+func TtsCacheKey(text string, param SpeechSynthesisStartParam, extra map[string]interface{}) string {
+	//maps marshal with sorted keys, so equal requests hash equally
+	b, _ := json.Marshal(struct {
+		Text  string                    `json:"text"`
+		Param SpeechSynthesisStartParam `json:"param"`
+		Extra map[string]interface{}    `json:"extra,omitempty"`
+	}{text, param, extra})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type ttsLruItem struct {
+	key     string
+	size    int64
+	created time.Time
+	//nil for the disk backend
+	entry *TtsCacheEntry
+}
+
+// ttsLru keeps the recency order and the total size of a backend
+type ttsLru struct {
+	maxBytes int64
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+	size     int64
+}
+
+func newTtsLru(maxBytes int64, ttl time.Duration) *ttsLru {
+	return &ttsLru{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (lru *ttsLru) expired(item *ttsLruItem) bool {
+	return lru.ttl > 0 && time.Since(item.created) > lru.ttl
+}
+
+// get returns a live item and marks it used, expired ones are removed and
+// reported in the second result
+func (lru *ttsLru) get(key string) (*ttsLruItem, bool) {
+	elem, ok := lru.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*ttsLruItem)
+	if lru.expired(item) {
+		lru.remove(key)
+		return nil, true
+	}
+	lru.ll.MoveToFront(elem)
+	return item, false
+}
+
+// add returns the keys evicted to stay within maxBytes
+func (lru *ttsLru) add(item *ttsLruItem) []string {
+	lru.remove(item.key)
+	lru.items[item.key] = lru.ll.PushFront(item)
+	lru.size += item.size
+
+	var evicted []string
+	for lru.maxBytes > 0 && lru.size > lru.maxBytes {
+		oldest := lru.ll.Back().Value.(*ttsLruItem)
+		lru.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return evicted
+}
+
+func (lru *ttsLru) remove(key string) {
+	elem, ok := lru.items[key]
+	if !ok {
+		return
+	}
+	lru.ll.Remove(elem)
+	delete(lru.items, key)
+	lru.size -= elem.Value.(*ttsLruItem).size
+}
+
+// MemoryTtsCache keeps entries in memory up to maxBytes of audio and
+// subtitles, least recently used first out. ttl 0 keeps entries until
+// evicted.
+type MemoryTtsCache struct {
+	lk  sync.Mutex
+	lru *ttsLru
+}
+
+func NewMemoryTtsCache(maxBytes int64, ttl time.Duration) *MemoryTtsCache {
+	return &MemoryTtsCache{lru: newTtsLru(maxBytes, ttl)}
+}
+
+func (m *MemoryTtsCache) Get(key string) (*TtsCacheEntry, bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	item, _ := m.lru.get(key)
+	if item == nil {
+		return nil, false
+	}
+	return item.entry, true
+}
+
+func (m *MemoryTtsCache) Put(key string, entry *TtsCacheEntry) error {
+	size := entry.size()
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.lru.maxBytes > 0 && size > m.lru.maxBytes {
+		return nil
+	}
+	m.lru.add(&ttsLruItem{key: key, size: size, created: entry.Created, entry: entry})
+	return nil
+}
+
+// bytes held
+func (m *MemoryTtsCache) Size() int64 {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.lru.size
+}
+
+// DiskTtsCache keeps every entry as two files in dir, the raw audio and a
+// json with the subtitles, and survives restarts.
+type DiskTtsCache struct {
+	dir string
+	lk  sync.Mutex
+	lru *ttsLru
+}
+
+type diskTtsMeta struct {
+	Created  int64    `json:"created_ms"`
+	MetaInfo []string `json:"meta_info,omitempty"`
+}
+
+// NewDiskTtsCache creates dir if needed and indexes the entries already
+// in it, ordered by last use.
+func NewDiskTtsCache(dir string, maxBytes int64, ttl time.Duration) (*DiskTtsCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DiskTtsCache{dir: dir, lru: newTtsLru(maxBytes, ttl)}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		item *ttsLruItem
+		used time.Time
+	}
+	var entries []found
+	complete := make(map[string]bool)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ttsCacheMetaExt) {
+			complete[strings.TrimSuffix(f.Name(), ttsCacheMetaExt)] = true
+		}
+	}
+	for _, f := range files {
+		//left over by a crash between the writes of an entry
+		if strings.HasPrefix(f.Name(), ".tmp-") ||
+			(strings.HasSuffix(f.Name(), ttsCacheAudioExt) && !complete[strings.TrimSuffix(f.Name(), ttsCacheAudioExt)]) {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), ttsCacheMetaExt) {
+			continue
+		}
+		key := strings.TrimSuffix(f.Name(), ttsCacheMetaExt)
+		meta, size, err := d.readMeta(key)
+		if err != nil {
+			d.removeFiles(key)
+			continue
+		}
+		entries = append(entries, found{
+			item: &ttsLruItem{key: key, size: size, created: time.Unix(0, meta.Created*int64(time.Millisecond))},
+			used: f.ModTime(),
+		})
+	}
+	//oldest first, so the most recently used ends at the front
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	for _, e := range entries {
+		if d.lru.expired(e.item) {
+			d.removeFiles(e.item.key)
+			continue
+		}
+		for _, key := range d.lru.add(e.item) {
+			d.removeFiles(key)
+		}
+	}
+	return d, nil
+}
+
+func (d *DiskTtsCache) path(key string, ext string) string {
+	return filepath.Join(d.dir, key+ext)
+}
+
+func (d *DiskTtsCache) readMeta(key string) (*diskTtsMeta, int64, error) {
+	b, err := ioutil.ReadFile(d.path(key, ttsCacheMetaExt))
+	if err != nil {
+		return nil, 0, err
+	}
+	meta := new(diskTtsMeta)
+	err = json.Unmarshal(b, meta)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := os.Stat(d.path(key, ttsCacheAudioExt))
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+	for _, m := range meta.MetaInfo {
+		size += int64(len(m))
+	}
+	return meta, size, nil
+}
+
+func (d *DiskTtsCache) removeFiles(key string) {
+	//the meta file marks a complete entry, it goes first
+	os.Remove(d.path(key, ttsCacheMetaExt))
+	os.Remove(d.path(key, ttsCacheAudioExt))
+}
+
+func (d *DiskTtsCache) Get(key string) (*TtsCacheEntry, bool) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	item, expired := d.lru.get(key)
+	if expired {
+		d.removeFiles(key)
+	}
+	if item == nil {
+		return nil, false
+	}
+
+	meta, _, err := d.readMeta(key)
+	if err != nil {
+		d.lru.remove(key)
+		d.removeFiles(key)
+		return nil, false
+	}
+	audio, err := ioutil.ReadFile(d.path(key, ttsCacheAudioExt))
+	if err != nil {
+		d.lru.remove(key)
+		d.removeFiles(key)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(d.path(key, ttsCacheMetaExt), now, now)
+
+	return &TtsCacheEntry{Audio: audio, MetaInfo: meta.MetaInfo, Created: item.created}, true
+}
+
+func (d *DiskTtsCache) Put(key string, entry *TtsCacheEntry) error {
+	size := entry.size()
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.lru.maxBytes > 0 && size > d.lru.maxBytes {
+		return nil
+	}
+
+	meta, err := json.Marshal(diskTtsMeta{
+		Created:  entry.Created.UnixNano() / int64(time.Millisecond),
+		MetaInfo: entry.MetaInfo,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.writeFile(d.path(key, ttsCacheAudioExt), entry.Audio)
+	if err == nil {
+		err = d.writeFile(d.path(key, ttsCacheMetaExt), meta)
+	}
+	if err != nil {
+		d.removeFiles(key)
+		return err
+	}
+
+	for _, evicted := range d.lru.add(&ttsLruItem{key: key, size: size, created: entry.Created}) {
+		d.removeFiles(evicted)
+	}
+	return nil
+}
+
+// write and rename, readers never see a partial file
+func (d *DiskTtsCache) writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(d.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// bytes held
+func (d *DiskTtsCache) Size() int64 {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.lru.size
+}
+
+type TtsCacheStats struct {
+	Hits int64
+	//requests that waited for an identical synthesis already running
+	Coalesced int64
+	Misses    int64
+	Errors    int64
+}
+
+type ttsCall struct {
+	done  chan struct{}
+	entry *TtsCacheEntry
+	err   error
+}
+
+// TtsCache answers repeated synthesis requests from its backends without
+// a network call. Backends are asked in order, a hit in a later one is
+// copied to the earlier ones, and a miss is synthesized once however many
+// callers ask for it at the same time. Failed syntheses are not cached.
+type TtsCache struct {
+	//bounds one synthesis, independent of the contexts of its callers
+	Timeout time.Duration
+
+	config   *ConnectionConfig
+	logger   *NlsLogger
+	backends []TtsCacheBackend
+	pool     *ConnectionPool
+
+	lk    sync.Mutex
+	calls map[string]*ttsCall
+	stats TtsCacheStats
+}
+
+func NewTtsCache(config *ConnectionConfig, logger *NlsLogger, backends ...TtsCacheBackend) (*TtsCache, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("no cache backend")
+	}
+	if logger == nil {
+		logger = DefaultNlsLog()
+	}
+
+	cache := new(TtsCache)
+	cache.Timeout = DEFAULT_TTS_CACHE_TIMEOUT
+	cache.config = config
+	cache.logger = logger
+	cache.backends = backends
+	cache.calls = make(map[string]*ttsCall)
+	return cache, nil
+}
+
+// synthesize misses on warm connections from pool
+func (cache *TtsCache) SetConnectionPool(pool *ConnectionPool) {
+	cache.lk.Lock()
+	defer cache.lk.Unlock()
+	cache.pool = pool
+}
+
+func (cache *TtsCache) Stats() TtsCacheStats {
+	cache.lk.Lock()
+	defer cache.lk.Unlock()
+	return cache.stats
+}
+
+func (cache *TtsCache) lookup(key string) *TtsCacheEntry {
+	for i, backend := range cache.backends {
+		entry, ok := backend.Get(key)
+		if !ok {
+			continue
+		}
+		for _, earlier := range cache.backends[:i] {
+			earlier.Put(key, entry)
+		}
+		return entry
+	}
+	return nil
+}
+
+// Synthesize returns the cached entry for the request or synthesizes it.
+// ctx only bounds the wait of this caller.
+func (cache *TtsCache) Synthesize(ctx context.Context,
+	text string,
+	param SpeechSynthesisStartParam,
+	extra map[string]interface{}) (*TtsCacheEntry, error) {
+	key := TtsCacheKey(text, param, extra)
+	entry := cache.lookup(key)
+
+	cache.lk.Lock()
+	if entry != nil {
+		cache.stats.Hits++
+		cache.lk.Unlock()
+		return entry, nil
+	}
+	call, running := cache.calls[key]
+	if running {
+		cache.stats.Coalesced++
+	} else {
+		cache.stats.Misses++
+		call = &ttsCall{done: make(chan struct{})}
+		cache.calls[key] = call
+		go cache.fill(key, call, text, param, extra)
+	}
+	cache.lk.Unlock()
+
+	select {
+	case <-call.done:
+		return call.entry, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cache *TtsCache) fill(key string, call *ttsCall, text string, param SpeechSynthesisStartParam, extra map[string]interface{}) {
+	call.entry, call.err = cache.synthesize(text, param, extra)
+	if call.err == nil {
+		for _, backend := range cache.backends {
+			err := backend.Put(key, call.entry)
+			if err != nil {
+				cache.logger.Println("tts cache put failed:", err)
+			}
+		}
+	}
+
+	cache.lk.Lock()
+	delete(cache.calls, key)
+	if call.err != nil {
+		cache.stats.Errors++
+	}
+	cache.lk.Unlock()
+	close(call.done)
+}
+
+func (cache *TtsCache) synthesize(text string, param SpeechSynthesisStartParam, extra map[string]interface{}) (*TtsCacheEntry, error) {
+	var lk sync.Mutex
+	entry := new(TtsCacheEntry)
+	tts, err := NewSpeechSynthesis(cache.config, cache.logger, false,
+		nil,
+		func(data []byte, param interface{}) {
+			lk.Lock()
+			entry.Audio = append(entry.Audio, data...)
+			lk.Unlock()
+		},
+		func(text string, param interface{}) {
+			lk.Lock()
+			entry.MetaInfo = append(entry.MetaInfo, text)
+			lk.Unlock()
+		},
+		nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	cache.lk.Lock()
+	pool := cache.pool
+	cache.lk.Unlock()
+	defer tts.Shutdown()
+	if pool != nil {
+		err = tts.SetConnectionPool(pool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := cache.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TTS_CACHE_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done, err := tts.StartContext(ctx, text, param, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		if !ok {
+			if lastErr := tts.LastError(); lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, errors.New("synthesis failed")
+		}
+	case <-timer.C:
+		return nil, errors.New("timeout waiting for SynthesisCompleted")
+	}
+
+	lk.Lock()
+	defer lk.Unlock()
+	if len(entry.Audio) == 0 {
+		return nil, errors.New("synthesis completed without audio")
+	}
+	entry.Created = time.Now()
+	return entry, nil
+}
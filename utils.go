@@ -19,6 +19,7 @@ limitations under the License.
 package nls
 
 import (
+	"fmt"
 	"io"
 	"strings"
 
@@ -83,6 +84,9 @@ type Header struct {
 	Namespace string `json:"namespace"`
 	Name      string `json:"name"`
 	Appkey    string `json:"appkey"`
+
+	Status     int    `json:"status,omitempty"`
+	StatusText string `json:"status_text,omitempty"`
 }
 
 type SDK struct {
@@ -144,6 +148,34 @@ func LoadPcmInChunk(r io.Reader, chunkSize int) *ChunkBuffer {
 	return buffer
 }
 
+// Bool, Int and Float64 return pointers for the optional fields of the
+// start params, a nil field is not sent and the server default applies.
+func Bool(v bool) *bool {
+	return &v
+}
+
+func Int(v int) *int {
+	return &v
+}
+
+func Float64(v float64) *float64 {
+	return &v
+}
+
+func checkIntRange(name string, v int, min int, max int) error {
+	if v < min || v > max {
+		return fmt.Errorf("invalid param: %s %d out of range [%d, %d]", name, v, min, max)
+	}
+	return nil
+}
+
+func checkSampleRate(rate int) error {
+	if rate != 0 && rate != 8000 && rate != 16000 {
+		return fmt.Errorf("invalid param: sample_rate %d, expect 8000 or 16000", rate)
+	}
+	return nil
+}
+
 func getUuid() string {
 	return strings.ReplaceAll(uuid.NewV4().String(), "-", "")
 }
@@ -0,0 +1,271 @@
+/*
+vocab.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_VOCAB_DOMAIN  = "nls-slp.cn-shanghai.aliyuncs.com"
+	DEFAULT_VOCAB_VERSION = "2018-11-20"
+
+	VOCAB_MIN_WEIGHT = -6
+	VOCAB_MAX_WEIGHT = 5
+	VOCAB_MAX_WORDS  = 500
+	//characters of a Chinese entry, words of an English one
+	VOCAB_MAX_WORD_LEN = 10
+)
+
+// hotword -> weight, a weight of -6 keeps the word out of the result
+type WordWeights map[string]int
+
+func (w WordWeights) Validate() error {
+	if len(w) == 0 {
+		return errors.New("invalid vocab: no words")
+	}
+	if len(w) > VOCAB_MAX_WORDS {
+		return fmt.Errorf("invalid vocab: %d words, at most %d", len(w), VOCAB_MAX_WORDS)
+	}
+	for word, weight := range w {
+		if strings.TrimSpace(word) == "" || wordLen(word) > VOCAB_MAX_WORD_LEN {
+			return fmt.Errorf("invalid vocab: %q must have 1 to %d Chinese characters or English words",
+				word, VOCAB_MAX_WORD_LEN)
+		}
+		if weight < VOCAB_MIN_WEIGHT || weight > VOCAB_MAX_WEIGHT {
+			return fmt.Errorf("invalid vocab: weight %d of %q out of range [%d, %d]",
+				weight, word, VOCAB_MIN_WEIGHT, VOCAB_MAX_WEIGHT)
+		}
+	}
+	return nil
+}
+
+// Chinese entries are limited by characters, English ones by words
+func wordLen(word string) int {
+	for _, r := range word {
+		if unicode.Is(unicode.Han, r) {
+			return utf8.RuneCountInString(strings.Join(strings.Fields(word), ""))
+		}
+	}
+	return len(strings.Fields(word))
+}
+
+type AsrVocab struct {
+	Id          string      `json:"Id"`
+	Name        string      `json:"Name"`
+	Description string      `json:"Description"`
+	Size        int         `json:"Size"`
+	Md5         string      `json:"Md5"`
+	CreateTime  string      `json:"CreateTime"`
+	UpdateTime  string      `json:"UpdateTime"`
+	WordWeights WordWeights `json:"WordWeights,omitempty"`
+}
+
+type CreateAsrVocabRequest struct {
+	Name        string
+	Description string
+	WordWeights WordWeights
+}
+
+type UpdateAsrVocabRequest struct {
+	Id          string
+	Name        string
+	Description string
+	WordWeights WordWeights
+}
+
+type ListAsrVocabRequest struct {
+	//1 based, 0 means the first page
+	PageNumber int
+	//0 means the server default
+	PageSize int
+}
+
+type CreateAsrVocabResponse struct {
+	RequestId string `json:"RequestId"`
+	VocabId   string `json:"VocabId"`
+}
+
+type GetAsrVocabResponse struct {
+	RequestId string   `json:"RequestId"`
+	Vocab     AsrVocab `json:"Vocab"`
+}
+
+type AsrVocabPage struct {
+	Content    []AsrVocab `json:"Content"`
+	PageNumber int        `json:"PageNumber"`
+	PageSize   int        `json:"PageSize"`
+	TotalPages int        `json:"TotalPages"`
+	TotalItems int        `json:"TotalItems"`
+}
+
+type ListAsrVocabResponse struct {
+	RequestId string       `json:"RequestId"`
+	Page      AsrVocabPage `json:"Page"`
+}
+
+type AsrVocabResponse struct {
+	RequestId string `json:"RequestId"`
+}
+
+// VocabClient manages hotword vocabularies, the Id of a vocabulary is the
+// vocabulary_id of the recognition start params.
+type VocabClient struct {
+	PopClient
+}
+
+func NewVocabClient(akid string, akkey string) (*VocabClient, error) {
+	return NewVocabClientWithRegion(DEFAULT_DISTRIBUTE, akid, akkey)
+}
+
+func NewVocabClientWithRegion(region string, akid string, akkey string) (*VocabClient, error) {
+	if akid == "" || akkey == "" {
+		return nil, errors.New("empty akid or akkey")
+	}
+	pop, err := newPopClient(region, akid, akkey, DEFAULT_VOCAB_DOMAIN, DEFAULT_VOCAB_VERSION)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VocabClient{PopClient: *pop}, nil
+}
+
+// reuses the access key of a config made by NewConnectionConfigWithAKInfoDefault
+func NewVocabClientWithConfig(config *ConnectionConfig) (*VocabClient, error) {
+	if config == nil {
+		return nil, errors.New("empty config")
+	}
+	return NewVocabClient(config.Akid, config.Akkey)
+}
+
+func (vocab *VocabClient) CreateAsrVocab(req CreateAsrVocabRequest) (*CreateAsrVocabResponse, error) {
+	if req.Name == "" {
+		return nil, errors.New("invalid vocab: empty name")
+	}
+	err := req.WordWeights.Validate()
+	if err != nil {
+		return nil, err
+	}
+	words, err := json.Marshal(req.WordWeights)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]string{
+		"Name":        req.Name,
+		"WordWeights": string(words),
+	}
+	if req.Description != "" {
+		params["Description"] = req.Description
+	}
+
+	resp := new(CreateAsrVocabResponse)
+	err = vocab.call("CreateAsrVocab", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (vocab *VocabClient) GetAsrVocab(id string) (*GetAsrVocabResponse, error) {
+	if id == "" {
+		return nil, errors.New("invalid vocab: empty id")
+	}
+
+	resp := new(GetAsrVocabResponse)
+	err := vocab.call("GetAsrVocab", map[string]string{"Id": id}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// replaces name, description and the whole word list of the vocabulary
+func (vocab *VocabClient) UpdateAsrVocab(req UpdateAsrVocabRequest) (*AsrVocabResponse, error) {
+	if req.Id == "" {
+		return nil, errors.New("invalid vocab: empty id")
+	}
+	if req.Name == "" {
+		return nil, errors.New("invalid vocab: empty name")
+	}
+	err := req.WordWeights.Validate()
+	if err != nil {
+		return nil, err
+	}
+	words, err := json.Marshal(req.WordWeights)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]string{
+		"Id":          req.Id,
+		"Name":        req.Name,
+		"WordWeights": string(words),
+	}
+	if req.Description != "" {
+		params["Description"] = req.Description
+	}
+
+	resp := new(AsrVocabResponse)
+	err = vocab.call("UpdateAsrVocab", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (vocab *VocabClient) DeleteAsrVocab(id string) (*AsrVocabResponse, error) {
+	if id == "" {
+		return nil, errors.New("invalid vocab: empty id")
+	}
+
+	resp := new(AsrVocabResponse)
+	err := vocab.call("DeleteAsrVocab", map[string]string{"Id": id}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (vocab *VocabClient) ListAsrVocab(req ListAsrVocabRequest) (*ListAsrVocabResponse, error) {
+	if req.PageNumber < 0 || req.PageSize < 0 {
+		return nil, errors.New("invalid vocab: negative page")
+	}
+
+	params := make(map[string]string)
+	if req.PageNumber > 0 {
+		params["PageNumber"] = strconv.Itoa(req.PageNumber)
+	}
+	if req.PageSize > 0 {
+		params["PageSize"] = strconv.Itoa(req.PageSize)
+	}
+
+	resp := new(ListAsrVocabResponse)
+	err := vocab.call("ListAsrVocab", params, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,257 @@
+/*
+vocab_test.go
+
+Copyright 1999-present Alibaba Group Holding Ltd.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nls
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// in-memory vocabularies of the nls-slp api stand-in
+type vocabStore struct {
+	vocabs map[string]AsrVocab
+	nextId int
+}
+
+func (v *vocabStore) actions() map[string]popAction {
+	return map[string]popAction{
+		"CreateAsrVocab": func(q url.Values) (int, interface{}) {
+			words := WordWeights{}
+			err := json.Unmarshal([]byte(q.Get("WordWeights")), &words)
+			if err != nil {
+				return popError(http.StatusBadRequest, "InvalidParameter")
+			}
+			v.nextId++
+			id := "vocab-" + strconv.Itoa(v.nextId)
+			v.vocabs[id] = AsrVocab{Id: id, Name: q.Get("Name"),
+				Description: q.Get("Description"), Size: len(words), WordWeights: words}
+			return 0, CreateAsrVocabResponse{RequestId: "req", VocabId: id}
+		},
+		"GetAsrVocab": func(q url.Values) (int, interface{}) {
+			vocab, ok := v.vocabs[q.Get("Id")]
+			if !ok {
+				return popError(http.StatusNotFound, "VocabNotFound")
+			}
+			return 0, GetAsrVocabResponse{RequestId: "req", Vocab: vocab}
+		},
+		"UpdateAsrVocab": func(q url.Values) (int, interface{}) {
+			vocab, ok := v.vocabs[q.Get("Id")]
+			if !ok {
+				return popError(http.StatusNotFound, "VocabNotFound")
+			}
+			words := WordWeights{}
+			json.Unmarshal([]byte(q.Get("WordWeights")), &words)
+			vocab.Name = q.Get("Name")
+			vocab.Description = q.Get("Description")
+			vocab.Size = len(words)
+			vocab.WordWeights = words
+			v.vocabs[vocab.Id] = vocab
+			return 0, AsrVocabResponse{RequestId: "req"}
+		},
+		"DeleteAsrVocab": func(q url.Values) (int, interface{}) {
+			if _, ok := v.vocabs[q.Get("Id")]; !ok {
+				return popError(http.StatusNotFound, "VocabNotFound")
+			}
+			delete(v.vocabs, q.Get("Id"))
+			return 0, AsrVocabResponse{RequestId: "req"}
+		},
+		"ListAsrVocab": func(q url.Values) (int, interface{}) {
+			page := AsrVocabPage{PageNumber: 1, PageSize: 10, TotalItems: len(v.vocabs), TotalPages: 1}
+			for _, vocab := range v.vocabs {
+				vocab.WordWeights = nil
+				page.Content = append(page.Content, vocab)
+			}
+			return 0, ListAsrVocabResponse{RequestId: "req", Page: page}
+		},
+	}
+}
+
+func newTestVocabClient(t *testing.T) (*VocabClient, *popServer) {
+	vocab, err := NewVocabClient("akid", "akkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &vocabStore{vocabs: make(map[string]AsrVocab)}
+	return vocab, newPopServer(t, &vocab.PopClient, store.actions())
+}
+
+func TestVocabLifecycle(t *testing.T) {
+	vocab, s := newTestVocabClient(t)
+
+	created, err := vocab.CreateAsrVocab(CreateAsrVocabRequest{
+		Name:        "products",
+		Description: "product names",
+		WordWeights: WordWeights{"阿里云": 3, "通义": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.VocabId == "" {
+		t.Fatal("empty vocab id")
+	}
+	call := s.lastCall()
+	if call.Get("Version") != DEFAULT_VOCAB_VERSION || call.Get("Name") != "products" {
+		t.Fatalf("unexpected create params: %v", call)
+	}
+
+	got, err := vocab.GetAsrVocab(created.VocabId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Vocab.Size != 2 || got.Vocab.WordWeights["阿里云"] != 3 || got.Vocab.Description != "product names" {
+		t.Fatalf("unexpected vocab: %+v", got.Vocab)
+	}
+
+	_, err = vocab.UpdateAsrVocab(UpdateAsrVocabRequest{
+		Id:          created.VocabId,
+		Name:        "products-v2",
+		WordWeights: WordWeights{"通义千问": 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = vocab.GetAsrVocab(created.VocabId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Vocab.Name != "products-v2" || got.Vocab.Size != 1 || got.Vocab.WordWeights["通义千问"] != 5 {
+		t.Fatalf("update not applied: %+v", got.Vocab)
+	}
+
+	list, err := vocab.ListAsrVocab(ListAsrVocabRequest{PageNumber: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Page.Content) != 1 || list.Page.Content[0].Id != created.VocabId {
+		t.Fatalf("unexpected list: %+v", list.Page)
+	}
+	call = s.lastCall()
+	if call.Get("PageNumber") != "1" || call.Get("PageSize") != "10" {
+		t.Fatalf("unexpected list params: %v", call)
+	}
+
+	_, err = vocab.DeleteAsrVocab(created.VocabId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err = vocab.ListAsrVocab(ListAsrVocabRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Page.Content) != 0 {
+		t.Fatalf("vocab still listed after delete: %+v", list.Page)
+	}
+	call = s.lastCall()
+	if _, ok := call["PageNumber"]; ok {
+		t.Fatalf("zero page number sent: %v", call)
+	}
+}
+
+func TestVocabServerError(t *testing.T) {
+	vocab, _ := newTestVocabClient(t)
+
+	_, err := vocab.GetAsrVocab("missing")
+	if err == nil || !strings.Contains(err.Error(), "VocabNotFound") {
+		t.Fatalf("expected VocabNotFound, got %v", err)
+	}
+	_, err = vocab.UpdateAsrVocab(UpdateAsrVocabRequest{Id: "missing", Name: "n", WordWeights: WordWeights{"a": 1}})
+	if err == nil {
+		t.Fatal("update of a missing vocab succeeded")
+	}
+	_, err = vocab.DeleteAsrVocab("missing")
+	if err == nil {
+		t.Fatal("delete of a missing vocab succeeded")
+	}
+}
+
+func TestVocabWordLength(t *testing.T) {
+	valid := WordWeights{
+		"microservices":     2,
+		"Kubernetes1":       2,
+		"Alibaba Cloud ECS": 3,
+		"中华人民共和国国务院":        1,
+		"通义 千问":             1,
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVocabValidation(t *testing.T) {
+	vocab, s := newTestVocabClient(t)
+
+	cases := []struct {
+		name string
+		call func() error
+	}{
+		{"create without name", func() error {
+			_, err := vocab.CreateAsrVocab(CreateAsrVocabRequest{WordWeights: WordWeights{"a": 1}})
+			return err
+		}},
+		{"create without words", func() error {
+			_, err := vocab.CreateAsrVocab(CreateAsrVocabRequest{Name: "n"})
+			return err
+		}},
+		{"weight out of range", func() error {
+			_, err := vocab.CreateAsrVocab(CreateAsrVocabRequest{Name: "n", WordWeights: WordWeights{"a": 6}})
+			return err
+		}},
+		{"chinese word too long", func() error {
+			_, err := vocab.CreateAsrVocab(CreateAsrVocabRequest{Name: "n", WordWeights: WordWeights{"阿里巴巴达摩院语音实验室": 1}})
+			return err
+		}},
+		{"english phrase too long", func() error {
+			_, err := vocab.CreateAsrVocab(CreateAsrVocabRequest{Name: "n",
+				WordWeights: WordWeights{"one two three four five six seven eight nine ten eleven": 1}})
+			return err
+		}},
+		{"blank word", func() error {
+			_, err := vocab.CreateAsrVocab(CreateAsrVocabRequest{Name: "n", WordWeights: WordWeights{" ": 1}})
+			return err
+		}},
+		{"get without id", func() error {
+			_, err := vocab.GetAsrVocab("")
+			return err
+		}},
+		{"update without id", func() error {
+			_, err := vocab.UpdateAsrVocab(UpdateAsrVocabRequest{Name: "n", WordWeights: WordWeights{"a": 1}})
+			return err
+		}},
+		{"delete without id", func() error {
+			_, err := vocab.DeleteAsrVocab("")
+			return err
+		}},
+		{"negative page", func() error {
+			_, err := vocab.ListAsrVocab(ListAsrVocabRequest{PageNumber: -1})
+			return err
+		}},
+	}
+	for _, c := range cases {
+		if c.call() == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+	if n := s.callCount(""); n != 0 {
+		t.Fatalf("invalid requests reached the server %d times", n)
+	}
+}
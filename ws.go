@@ -20,10 +20,13 @@ package nls
 
 import (
 	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"net/http"
 )
 
 type wsConnection struct {
@@ -33,10 +36,20 @@ type wsConnection struct {
 	closef func(int, string, error)
 
 	logger *NlsLogger
+
+	//gorilla allows one concurrent writer, pings share the socket
+	wlk sync.Mutex
+	//closed when the read loop exits
+	done chan struct{}
+	//closef fires once, for a close frame or a connection lost without one
+	closeOnce sync.Once
+	//set by shutdown and closeGracefully, a close of our own is not
+	//reported unless the server answers it
+	local int32
 }
 
 func newWsConnection(url string, token string, handshakeTimeout time.Duration,
-	readBufferSize int, writeBufferSize int, logger *NlsLogger,
+	readBufferSize int, writeBufferSize int, dialRetry int, logger *NlsLogger,
 	recvHandler func(rawData bool, data []byte),
 	closeHandler func(code int, text string, err error)) (*wsConnection, error) {
 	if recvHandler == nil {
@@ -54,13 +67,13 @@ func newWsConnection(url string, token string, handshakeTimeout time.Duration,
 	for {
 		err := connection.issueWsConnect(url, token, handshakeTimeout, readBufferSize, writeBufferSize)
 		if err != nil {
-			if err.Error() == "EOF" {
+			if errors.Is(err, io.EOF) {
 				connection.logger.Debugf("connection(%p) connect failed: %s retry: %d", connection, err, retry)
 				retry++
-				if retry >= 5 {
+				if retry >= dialRetry {
 					return nil, err
 				}
-        time.Sleep(10 * time.Millisecond)
+				time.Sleep(10 * time.Millisecond)
 			} else {
 				connection.logger.Debugf("connection(%p) connect failed: %s", connection, err)
 				return nil, err
@@ -73,13 +86,14 @@ func newWsConnection(url string, token string, handshakeTimeout time.Duration,
 		connection.connection.UnderlyingConn().LocalAddr().String())
 
 	connection.recvf = recvHandler
-	connection.startResultHandler()
-
 	if closeHandler != nil {
 		connection.closef = closeHandler
 		connection.setCloseHandler()
 	}
 
+	connection.done = make(chan struct{})
+	connection.startResultHandler()
+
 	return connection, nil
 }
 
@@ -94,9 +108,13 @@ func (conn *wsConnection) issueWsConnect(url string, token string, handshakeTime
 		WriteBufferSize:  writeBufferSize,
 	}
 
-	c, _, err := dialer.Dial(url, header)
+	c, resp, err := dialer.Dial(url, header)
 	if err != nil {
-		return err
+		dialErr := &DialError{Url: url, Err: err}
+		if resp != nil {
+			dialErr.StatusCode = resp.StatusCode
+		}
+		return dialErr
 	}
 
 	conn.connection = c
@@ -116,9 +134,13 @@ func (conn *wsConnection) setPingInterval(timeout time.Duration) {
 	go func() {
 		for {
 			select {
+			case <-conn.done:
+				return
 			case <-time.After(timeout):
 				if conn != nil {
+					conn.wlk.Lock()
 					err := conn.connection.WriteMessage(websocket.PingMessage, []byte{})
+					conn.wlk.Unlock()
 					if err != nil {
 						conn.logger.Debugln("write ping msg failed:", err)
 						return
@@ -135,6 +157,8 @@ func (conn *wsConnection) sendTextData(data string) error {
 	}
 
 	conn.logger.Debugln("ws write:", data)
+	conn.wlk.Lock()
+	defer conn.wlk.Unlock()
 	return conn.connection.WriteMessage(websocket.TextMessage, []byte(data))
 }
 
@@ -143,6 +167,8 @@ func (conn *wsConnection) sendRequest(req CommonRequest) error {
 		return errors.New("nil connection in sendTextData")
 	}
 
+	conn.wlk.Lock()
+	defer conn.wlk.Unlock()
 	return conn.connection.WriteJSON(req)
 }
 
@@ -151,6 +177,8 @@ func (conn *wsConnection) sendBinary(bin []byte) error {
 		return errors.New("invalid params: nil connection or empty binary")
 	}
 
+	conn.wlk.Lock()
+	defer conn.wlk.Unlock()
 	return conn.connection.WriteMessage(websocket.BinaryMessage, bin)
 }
 
@@ -160,9 +188,15 @@ func (conn *wsConnection) startResultHandler() {
 	}
 
 	go func() {
+		defer close(conn.done)
 		for {
 			mtype, resp, err := conn.connection.ReadMessage()
 			if err != nil {
+				//a close frame was reported by the close handler already
+				if atomic.LoadInt32(&conn.local) == 0 {
+					conn.logger.Debugf("connection %p lost: %s", conn, err)
+					conn.reportClose(websocket.CloseAbnormalClosure, err.Error(), err)
+				}
 				return
 			}
 
@@ -185,11 +219,21 @@ func (conn *wsConnection) setCloseHandler() {
 
 	conn.connection.SetCloseHandler(func(code int, text string) error {
 		conn.logger.Debugf("connection %p closed", conn)
+		//answer the close frame, this fails harmlessly when the close
+		//was ours and the frame is the reply
+		reply := websocket.FormatCloseMessage(code, "")
+		conn.connection.WriteControl(websocket.CloseMessage, reply, time.Now().Add(time.Second))
 		err := conn.connection.Close()
+		conn.reportClose(code, text, err)
+		return err
+	})
+}
+
+func (conn *wsConnection) reportClose(code int, text string, err error) {
+	conn.closeOnce.Do(func() {
 		if conn.closef != nil {
 			conn.closef(code, text, err)
 		}
-		return err
 	})
 }
 
@@ -198,5 +242,39 @@ func (conn *wsConnection) shutdown() error {
 		return nil
 	}
 
+	atomic.StoreInt32(&conn.local, 1)
 	return conn.connection.Close()
 }
+
+// send a close frame and wait up to timeout for the server to answer it
+// and end the read loop before the socket is closed
+func (conn *wsConnection) closeGracefully(timeout time.Duration) error {
+	if conn == nil {
+		return nil
+	}
+
+	atomic.StoreInt32(&conn.local, 1)
+	deadline := time.Now().Add(timeout)
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	err := conn.connection.WriteControl(websocket.CloseMessage, msg, deadline)
+	if err == nil {
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-conn.done:
+		case <-timer.C:
+			err = errors.New("close handshake timed out")
+		}
+		timer.Stop()
+	}
+	conn.connection.Close()
+	return err
+}
+
+func (conn *wsConnection) isClosed() bool {
+	select {
+	case <-conn.done:
+		return true
+	default:
+		return false
+	}
+}